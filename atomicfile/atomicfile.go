@@ -0,0 +1,19 @@
+// Package atomicfile replaces files atomically
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Write writes a file through a temporary file in the same directory, so readers see either the old or the new content
+func Write( filename string, content []byte ) ( err error ) {
+	file, err := os.CreateTemp( filepath.Dir( filename ), "." + filepath.Base( filename ) + ".*" )
+	if err != nil { return }
+	defer func() { if err != nil { _ = os.Remove( file.Name() ) } }()
+	if _, err = file.Write( content ); err == nil { err = file.Chmod( 0644 ) }
+	if err == nil { err = file.Sync() }
+	if closeErr := file.Close(); err == nil { err = closeErr }
+	if err != nil { return }
+	return os.Rename( file.Name(), filename )
+}
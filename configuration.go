@@ -12,8 +12,11 @@ import (
 	flag "github.com/spf13/pflag"
 
 	"github.com/eventure/hide.client.linux/control"
+	"github.com/eventure/hide.client.linux/resolvers"
+	"github.com/eventure/hide.client.linux/resolvers/dnscrypt"
 	"github.com/eventure/hide.client.linux/resolvers/doh"
 	"github.com/eventure/hide.client.linux/resolvers/plain"
+	"github.com/eventure/hide.client.linux/resolvers/stub"
 	"github.com/eventure/hide.client.linux/rest"
 	"github.com/eventure/hide.client.linux/wireguard"
 	"gopkg.in/yaml.v2"
@@ -34,12 +37,18 @@ func NewConfiguration() *Configuration {										// Defaults
 		Config: &connection.Config {
 			WireGuard: &wireguard.Config{
 				Name:					"vpn",									// command line option "-i"
+				ExitName:				"vpn-exit",								// command line option "--exit-interface"
 				ListenPort:				0,										// command line option "-l"
 				Mark:					0,										// command line option "-m"
 				RoutingTable:			55555,									// command line option "-r"
 				RPDBPriority:			10,										// command line option "-R"
 				LeakProtection:			true,									// command line option "-k"
-				ResolvConfBackupFile:	"",										// command line option "-b"
+				ResolvConfBackupFile:	"resolv.conf.backup",					// command line option "-b"
+				ResolvConfKeep:			[]string{ "search", "domain", "edns0", "trust-ad" },	// command line option "--resolv-conf-keep"
+				ResolvConfTemplate:		"",										// Configuration file only, the built-in template gets used when empty
+				DnsManager:				wireguard.DnsAuto,						// command line option "--dns-manager"
+				DnsServers:				nil,									// command line option "--tunnel-dns"
+				DnsSearch:				nil,									// command line option "--dns-search"
 				DpdTimeout:				time.Minute,							// command line option "--dpd"
 				SplitTunnel:			"",										// command line option "-s"
 				IPv4:					true,									// command line options "-4" and "-6"
@@ -48,6 +57,7 @@ func NewConfiguration() *Configuration {										// Defaults
 			Rest: &rest.Config{
 				APIVersion:				"v1.0.0",								// Not configurable
 				Host:           		"",										// command line option "-n"
+				ExitHost:				"",										// command line option "-x"
 				Port:					432,									// command line option "-p"
 				Domain:					"hide.me",								// Not configurable
 				CA:						"CA.pem",								// command line option "--ca"
@@ -59,6 +69,11 @@ func NewConfiguration() *Configuration {										// Defaults
 				AccessTokenUpdateDelay: 2 * time.Second,						// Only configurable through the config file
 				Mark:					0,										// command line option "-m"
 				UseDoH:					true,									// command line option "--doh"
+				UseDnsCrypt:			true,									// command line option "--dnscrypt"
+				Resolvers:				resolvers.DefaultChain,					// command line option "--resolvers"
+				Hosts:					nil,									// Only configurable through the config file
+				EndpointCachePath:		"endpointCache.json",					// command line option "--endpoint-cache"
+				Pins:					rest.Pins{ Vpn: rest.DefaultVpnPins },	// Only configurable through the config file
 			},
 			DoH: &doh.Config {
 				Servers: []string{
@@ -84,10 +99,29 @@ func NewConfiguration() *Configuration {										// Defaults
 				UpdateURLs: []string{
 					"https://raw.githubusercontent.com/DNSCrypt/dnscrypt-resolvers/master/v3/public-resolvers.md",
 				},
+				UpdateInterval: time.Hour * 24,
 				Filename: "resolvers.txt",
+				MinisignKey: doh.DNSCryptMinisignKey,
+				CacheMinTtl: time.Minute,
+				CacheMaxTtl: time.Hour * 24,
+				CacheFilename: "",
+				UdpSize: 1232,
+				PaddingBlockSize: 128,
+				NoVerify: nil,
 			},
 			Plain: &plain.Config{
 				Servers: []string{ "209.250.251.37:53", "217.182.206.81:53" },
+				RequireVerification: false,										// command line option "--dns-verify"
+			},
+			DnsCrypt: &dnscrypt.Config{
+				Servers:				nil,									// Only configurable through the config file
+				Filename:				"resolvers.txt",						// DNSCrypt stamps get picked from the DoH resolver list
+			},
+			Stub: &stub.Config{
+				Enabled:				false,									// command line option "--dns-stub"
+				Address:				"127.0.0.153:53",						// command line option "--dns-stub-address"
+				Domains:				nil,									// command line option "--split-dns"
+				CacheSize:				4096,									// Only configurable through the config file
 			},
 		},
 		Control: &control.Config{
@@ -113,13 +147,18 @@ func ( c *Configuration ) Parse() ( err error ) {
 	flag.StringVarP		( &configurationFileName,			"config", "c",			"", "Configuration `filename`" )									// Configuration flag
 
 	flag.IntVarP		( &c.Rest.Port,						"port",	"p",			c.Rest.Port, "remote `port`" )										// REST flags
+	flag.StringVarP		( &c.Rest.ExitHost,					"exit", "x",			c.Rest.ExitHost, "multi-hop exit server `host` (fqdn, short name or an IP address)" )
 	flag.StringVar		( &c.Rest.CA,						"ca",					c.Rest.CA, "CA certificate bundle `filename`" )
 	flag.StringVarP		( &c.Rest.AccessTokenPath,			"tokenFile", "t",		c.Rest.AccessTokenPath, "access token `filename`" )
 	flag.StringVarP		( &c.Rest.Username,					"username", "u",		c.Rest.Username, "hide.me `username`" )
 	flag.StringVarP		( &c.Rest.Password,					"password", "P",		c.Rest.Password, "hide.me `password`" )
 	flag.BoolVar		( &c.Rest.PortForward.Enabled,		"pf",					c.Rest.PortForward.Enabled, "enable dynamic port-forwarding technologies (uPnP and NAT-PMP)" )
 	flag.StringSliceVar	( &c.Plain.Servers,					"dns",					c.Plain.Servers, "comma separated list of DNS `servers`" )			// Resolver flags
+	flag.BoolVar		( &c.Plain.RequireVerification,		"dns-verify",			c.Plain.RequireVerification, "reject hideservers.net answers which could not be verified" )
 	flag.BoolVar		( &c.Rest.UseDoH,					"doh",					c.Rest.UseDoH, "Use DNS-over-HTTPs" )
+	flag.BoolVar		( &c.Rest.UseDnsCrypt,				"dnscrypt",				c.Rest.UseDnsCrypt, "Use DNSCrypt when DNS-over-HTTPs fails" )
+	flag.StringSliceVar	( &c.Rest.Resolvers,				"resolvers",			c.Rest.Resolvers, "comma separated resolver chain, resolver `names` in the order of use (hosts, doh, dnscrypt, plain, previous, cache)" )
+	flag.StringVar		( &c.Rest.EndpointCachePath,		"endpoint-cache",		c.Rest.EndpointCachePath, "`filename` of the cache which keeps the addresses of successful lookups" )
 	flag.DurationVar	( &c.Rest.RestTimeout,				"rest-timeout",			c.Rest.RestTimeout, "REST call timeout" )
 
 	flag.BoolVar		( &c.Rest.Filter.ForceDns,			"forceDns",				c.Rest.Filter.ForceDns, "alway use hide.me DNS servers" )			// Filtering flags
@@ -136,6 +175,7 @@ func ( c *Configuration ) Parse() ( err error ) {
 	flag.StringSliceVar	( &c.Rest.Filter.Blacklist,			"blacklist",			c.Rest.Filter.Blacklist, "comma separated list of filtered `dns names`" )
 
 	flag.StringVarP		( &c.WireGuard.Name,				"interface", "i",		c.WireGuard.Name, "network `interface` name" )						// Link flags
+	flag.StringVar		( &c.WireGuard.ExitName,			"exit-interface",		c.WireGuard.ExitName, "multi-hop exit network `interface` name" )
 	flag.IntVarP		( &c.WireGuard.ListenPort,			"listen-port", "l",		c.WireGuard.ListenPort, "wireguard listen `port`" )
 	flag.IntVarP		( &c.WireGuard.Mark,				"firewall-mark", "m",	c.WireGuard.Mark, "firewall `mark` for wireguard and hide.me client originated traffic" )
 	flag.IntVarP		( &c.WireGuard.RoutingTable,		"routing-table", "r",	c.WireGuard.RoutingTable, "routing `table` to use" )
@@ -143,6 +183,13 @@ func ( c *Configuration ) Parse() ( err error ) {
 
 	flag.BoolVarP		( &c.WireGuard.LeakProtection,		"kill-switch", "k",		c.WireGuard.LeakProtection, "enable/disable leak protection a.k.a. kill-switch" )
 	flag.StringVarP		( &c.WireGuard.ResolvConfBackupFile,"resolv-conf-bak", "b",	c.WireGuard.ResolvConfBackupFile, "resolv.conf backup `filename`" )
+	flag.StringSliceVar	( &c.WireGuard.ResolvConfKeep,		"resolv-conf-keep",		c.WireGuard.ResolvConfKeep, "comma separated list of `directives` and options to keep from the original resolv.conf" )
+	flag.StringVar		( &c.WireGuard.DnsManager,			"dns-manager",			c.WireGuard.DnsManager, "DNS `backend` (auto, resolved, resolvconf, file, none)" )
+	flag.StringSliceVar	( &c.WireGuard.DnsServers,			"tunnel-dns",			c.WireGuard.DnsServers, "comma separated list of DNS server `addresses` to use inside the tunnel" )
+	flag.StringSliceVar	( &c.WireGuard.DnsSearch,			"dns-search",			c.WireGuard.DnsSearch, "comma separated list of DNS search `domains` to use inside the tunnel" )
+	flag.BoolVar		( &c.Stub.Enabled,					"dns-stub",				c.Stub.Enabled, "run a local caching DNS forwarder while connected" )	// DNS forwarder flags
+	flag.StringVar		( &c.Stub.Address,					"dns-stub-address",		c.Stub.Address, "local DNS forwarder listen `address`" )
+	splitDns := flag.StringToString(						"split-dns",			nil, "comma separated list of `suffix=server` pairs forwarded to other DNS servers by the local DNS forwarder" )
 
 	flag.DurationVar	( &c.WireGuard.DpdTimeout,			"dpd",					c.WireGuard.DpdTimeout, "DPD `timeout`" )
 	flag.StringVarP		( &c.WireGuard.SplitTunnel,			"split-tunnel", "s",	c.WireGuard.SplitTunnel, "comma separated list of `networks` (CIDRs) for which to bypass the VPN" )
@@ -165,9 +212,12 @@ func ( c *Configuration ) Parse() ( err error ) {
 		_, _ = fmt.Fprint( os.Stderr, "  categories - fetch and dump filtering category list\n" )
 		_, _ = fmt.Fprint( os.Stderr, "  service - run in remotely controlled service mode\n" )
 		_, _ = fmt.Fprint( os.Stderr, "  updateDoh - update DNS-over-HTTPs server list (resolvers.txt)\n" )
-		_, _ = fmt.Fprint( os.Stderr, "  resolve - resolve host using DNS-over-HTTPs\n" )
+		_, _ = fmt.Fprint( os.Stderr, "  doh stats - show DNS-over-HTTPs server statistics\n" )
+		_, _ = fmt.Fprint( os.Stderr, "  resolve - resolve host using the resolver chain (or the resolvers listed after the host)\n" )
 		_, _ = fmt.Fprint( os.Stderr, "  lookup - resolve host using DNS\n" )
+		_, _ = fmt.Fprint( os.Stderr, "  dnscheck - check the DNS of an established connection for leaks\n" )
 		_, _ = fmt.Fprint( os.Stderr, "  list [free] - fetch the server list (use \"free\" to list only free servers)\n" )
+		_, _ = fmt.Fprint( os.Stderr, "  pins [update] - show the effective certificate pins (or update the signed pin-set file)\n" )
 		_, _ = fmt.Fprint( os.Stderr, "host:\n" )
 		_, _ = fmt.Fprint( os.Stderr, "  fqdn, short name or an IP address of a hide.me server\n\n" )
 		_, _ = fmt.Fprint( os.Stderr, "options:\n" )
@@ -187,6 +237,12 @@ func ( c *Configuration ) Parse() ( err error ) {
 	}
 
 	c.Rest.Mark = c.WireGuard.Mark
+	c.Rest.RequireVerification = c.Plain.RequireVerification
+	for suffix, server := range *splitDns {
+		if c.Stub.Domains == nil { c.Stub.Domains = map[string][]string{} }
+		c.Stub.Domains[suffix] = append( c.Stub.Domains[suffix], server )
+	}
+	if c.Stub.Enabled && c.WireGuard.DnsManager == wireguard.DnsResolved { err = errors.New( "the DNS forwarder can't be combined with the " + wireguard.DnsResolved + " DNS manager" ); log.Println( "Conf: [ERR] Failed:", err.Error() ); return }
 	if *v4Only && *v6Only { err = errors.New( "IPv4 only and IPv6 only tunneling are mutually exclusive" ); log.Println( "Conf: [ERR] Failed:", err.Error() ); return }
 	if *v4Only { c.WireGuard.IPv6 = false }
 	if *v6Only { c.WireGuard.IPv4 = false }
@@ -12,8 +12,11 @@ import (
 	"time"
 	
 	"github.com/coreos/go-systemd/daemon"
+	"github.com/eventure/hide.client.linux/resolvers"
+	"github.com/eventure/hide.client.linux/resolvers/dnscrypt"
 	"github.com/eventure/hide.client.linux/resolvers/doh"
 	"github.com/eventure/hide.client.linux/resolvers/plain"
+	"github.com/eventure/hide.client.linux/resolvers/stub"
 	"github.com/eventure/hide.client.linux/rest"
 	"github.com/eventure/hide.client.linux/wireguard"
 )
@@ -32,6 +35,7 @@ const (
 	DpdTimeout = "dpd timeout"
 	DnsLookup = "dns lookup"
 	ExternalIps = "external ips"
+	DnsCheck = "dns check"
 )
 
 type State struct {
@@ -40,7 +44,15 @@ type State struct {
 	*rest.ConnectResponse		`json:",omitempty"`
 	Rx				int64		`json:"rx,omitempty"`
 	Tx				int64		`json:"tx,omitempty"`
+	Telemetry		*wireguard.Telemetry	`json:"telemetry,omitempty"`
+	ExitTelemetry	*wireguard.Telemetry	`json:"exitTelemetry,omitempty"`
 	Host			string		`json:"host,omitempty"`
+	ExitHost		string		`json:"exitHost,omitempty"`
+	Pin				*rest.MatchedPin		`json:"pin,omitempty"`
+	ExitPin			*rest.MatchedPin		`json:"exitPin,omitempty"`
+	Exit			*rest.ConnectResponse	`json:"exit,omitempty"`
+	EffectiveDns	*wireguard.DnsState		`json:"effectiveDns,omitempty"`
+	DnsCheck		*wireguard.DnsCheck		`json:"dnsCheck,omitempty"`
 	ExternalIpv4	net.IP		`json:"external_ip,omitempty"`
 	ExternalIpv6	net.IP		`json:"external_ipv6,omitempty"`
 }
@@ -52,6 +64,8 @@ type Config struct {
 	WireGuard		*wireguard.Config
 	DoH				*doh.Config
 	Plain			*plain.Config
+	DnsCrypt		*dnscrypt.Config
+	Stub			*stub.Config
 }
 
 type Connection struct {
@@ -59,15 +73,18 @@ type Connection struct {
 	*Config
 
 	restClient		*rest.Client
+	exitClient		*rest.Client																								// Multi-hop exit REST client, nil when single-hop
 	link			*wireguard.Link
-	dohResolver		*doh.Resolver
-	plainResolver	*plain.Resolver
+	exitLink		*wireguard.Link																								// Multi-hop exit link, nil when single-hop
+	resolvers		map[string]resolvers.Resolver	// Resolvers of the REST resolver chain
+	dnsForwarder	wireguard.DnsForwarder																		// Local DNS forwarder, nil when disabled
 
 	initStack		[]func()
 	connectStack	[]func()
 	
 	dpdTimer		*time.Timer
 	lastRx			int64
+	lastExitRx		int64
 	
 	connectTimer	*time.Timer
 	connectCancel	context.CancelFunc
@@ -82,7 +99,16 @@ type Connection struct {
 }
 
 func New( config *Config ) *Connection { return &Connection{ Config: config, state: &State{ Code: Clean }, initStack: make( []func(), 0 ), connectStack: make( []func(), 0 ) } }
-func ( c *Connection ) State() *State { c.Lock(); if c.state.Code == Connected { c.state.Rx, c.state.Tx, _ = c.link.Acct() }; c.Unlock(); return c.state }
+func ( c *Connection ) State() *State {
+	c.Lock()
+	if c.state.Code == Connected {
+		c.state.Rx, c.state.Tx, _ = c.link.Acct()
+		c.state.Telemetry, _ = c.link.Telemetry()																								// Kernel's view of the interface and the peer
+		if c.exitLink != nil { c.state.ExitTelemetry, _ = c.exitLink.Telemetry() }
+	}
+	c.Unlock()
+	return c.state
+}
 func ( c *Connection ) Code() ( code string ) { c.Lock(); code = c.state.Code; c.Unlock(); return }
 func ( c *Connection ) NotifySystemd( notifySystemd bool ) { c.notifySystemd = notifySystemd }
 func ( c *Connection ) SetConnectNotify( connectNotify func(err error) ) { c.Lock(); c.connectNotify = connectNotify; c.Unlock() }
@@ -100,19 +126,13 @@ func ( c *Connection ) Init() ( err error ) {
 	c.initStack = append( c.initStack, c.link.Close )
 	defer c.state.SetCode( Routed )																												// Make sure to set state to "routed" so that the initStack may be unwound in Shutdown
 
-	c.dohResolver = doh.New( c.Config.DoH )
-	c.dohResolver.Init()																														// Initialize DoHResolver
-	c.dohResolver.SetRouteOps( c.link )
-
-	c.plainResolver = plain.New( c.Config.Plain )
-	if err = c.plainResolver.Init(); err != nil { log.Println( "Init: [ERR] Plain resolver failed:", err ); return }
-	c.plainResolver.SetRouteOps( c.link )
+	if c.resolvers, err = c.Config.NewResolvers( c.Config.Rest, c.link ); err != nil { return }													// Create and initialize the resolvers of the resolver chain
 	
 	c.restClient = rest.New( c.Config.Rest )
 	if err = c.restClient.Init(); err != nil { log.Println( "Init: [ERR] REST Client setup failed:", err ); return }							// Initialize the REST client
 	if !c.restClient.HaveAccessToken() { err = errors.New( "no Access-Token"); log.Println( "Init: [ERR] Failed: ", err ); return }				// Access-Token is required for the Connect/Disconnect methods
-	c.restClient.SetDohResolver( c.dohResolver )
-	c.restClient.SetPlainResolver( c.plainResolver )
+	c.restClient.SetResolvers( c.resolvers )
+	c.restClient.SetRouteOps( c.link )
 
 	_, dhcpDestination, _ := net.ParseCIDR( "255.255.255.255/32" )																				// IPv4 DHCP VPN bypass "throw" route
 	if err = c.link.ThrowRouteAdd( "DHCP bypass", dhcpDestination ); err != nil { log.Println( "Init: [ERR] DHCP bypass route failed:", err ); return }
@@ -146,6 +166,7 @@ func ( c *Connection ) ScheduleConnect( in time.Duration ) {
 	c.Lock()
 	if c.connectTimer == nil { c.connectTimer = time.AfterFunc( in, c.Connect ) } else { c.connectTimer.Reset( in ) }
 	c.state.Host = c.Config.Rest.Host																											// Set the hostname to Host
+	c.state.ExitHost = c.Config.Rest.ExitHost																									// Set the multi-hop exit hostname ( if any )
 	log.Println( "Conn: Connecting in", in )
 	c.Unlock()
 }
@@ -175,6 +196,8 @@ func ( c *Connection ) Connect() {
 
 	c.StateNotify( &State{ Code: DnsLookup, Timestamp: time.Now() } )																			// Broadcast "dns lookup" state
 	if err = c.restClient.Resolve( ctx ); err != nil { log.Println( "Conn: [ERR] Resolve", c.Config.Rest.Host, "failed" ); return }				// Resolve the remote address
+	var exitClient *rest.Client
+	if len( c.Config.Rest.ExitHost ) > 0 { if exitClient, err = c.exitResolve( ctx ); err != nil { return } }									// Resolve the multi-hop exit server's address too
 	serverIpNet := wireguard.Ip2Net( c.restClient.Remote().IP )
 	c.StateNotify( c.state )																													// Rebroadcast "connecting"
 	
@@ -189,6 +212,7 @@ func ( c *Connection ) Connect() {
 	c.state.ConnectResponse, err = c.restClient.Connect( ctx, c.link.PublicKey() )																// Issue a REST Connect request
 	if err != nil { if urlError, ok := err.( *url.Error ); ok { err = urlError.Unwrap() }; log.Println( "Conn: [ERR] REST failed:", err.Error() ); return }
 	c.state.ConnectResponse.Print()																												// Print the response attributes ( connection properties )
+	c.state.Pin = c.restClient.MatchedPin()
 	c.Lock(); defer c.Unlock()																													// No errors, lock this Connection until done
 	cancel()
 	c.connectCancel = nil
@@ -201,9 +225,16 @@ func ( c *Connection ) Connect() {
 		}
 	})
 	
+	c.link.SetTransit( exitClient != nil )																										// Multi-hop entry link carries just the exit hop
+	c.dnsForwarder = nil
+	if c.Config.Stub != nil && c.Config.Stub.Enabled { c.dnsForwarder = stub.New( c.Config.Stub ) }											// Local DNS forwarder, when enabled, gets started along with the tunnel DNS
+	c.link.SetDnsForwarder( c.dnsForwarder )
 	if err = c.link.Up( c.state.ConnectResponse ); err != nil { log.Println( "Conn: [ERR] Link up failed:", err ); return }						// Configure the wireguard interface (DNS, rules, routes, addresses and the peer), must succeed
 	c.connectStack = append( c.connectStack, c.link.Down )
 	
+	if exitClient != nil { if err = c.connectExit( exitClient ); err != nil { return } }														// Connect to the multi-hop exit server through the entry link
+	if c.exitLink != nil { c.state.EffectiveDns = c.exitLink.DnsState() } else { c.state.EffectiveDns = c.link.DnsState() }					// Report the DNS actually in use
+	
 	if supported, err := daemon.SdNotify( false, daemon.SdNotifyReady ); c.notifySystemd && supported && err != nil {							// Send SystemD ready notification
 		log.Println( "Conn: [ERR] SystemD notification failed:", err )
 	}
@@ -217,6 +248,7 @@ func ( c *Connection ) Connect() {
 	go c.AccessTokenRefresh( true )																												// Refresh the Access-Token when required
 	go c.Filter()																																// Apply possible filters
 	go c.PortForward()																															// Activate port-forwarding
+	go func() { _, _ = c.DnsCheck( true ) }()																									// Check for DNS leaks
 	c.state.SetCode( Connected )																												// Connection is running now so set state to connected
 }
 
@@ -231,22 +263,34 @@ func ( c *Connection ) Disconnect( notify bool ) {
 	if c.connectCancel != nil { c.connectCancel(); c.connectCancel = nil  }																		// Stop a possible concurrent connect
 	for i := len(c.connectStack)-1; i >= 0; i-- { c.connectStack[i]() }
 	c.connectStack = c.connectStack[:0]
-	c.state.ConnectResponse = nil
+	c.state.ConnectResponse, c.state.Exit, c.exitLink, c.exitClient = nil, nil, nil, nil
+	c.state.Pin, c.state.ExitPin = nil, nil
+	c.state.EffectiveDns, c.state.DnsCheck = nil, nil
 	c.state.Rx,c.state.Tx = 0, 0
+	c.state.Telemetry, c.state.ExitTelemetry = nil, nil
 	c.state.SetCode( Routed )																													// Set state to routed
 	if notify { c.StateNotify( c.state ) }
 	c.Unlock()
 }
 
+// sessionClient returns the REST client of the server the traffic exits through, i.e. the exit server's client when multi-hop
+func ( c *Connection ) sessionClient() ( client *rest.Client ) {
+	c.Lock(); defer c.Unlock()
+	if c.exitClient != nil { return c.exitClient }
+	return c.restClient
+}
+
 func ( c *Connection ) AccessTokenRefresh( notify bool ) {
-	if !c.state.ConnectResponse.StaleAccessToken { return }																						// Access token is not stale
-	if len( c.restClient.Config.AccessTokenPath ) == 0 { return }																				// Access token is not stored
-	log.Println( "AcRe: Updating the Access-Token in", c.restClient.Config.AccessTokenUpdateDelay )
-	time.AfterFunc( c.restClient.Config.AccessTokenUpdateDelay, func() {
-		ctx, cancel := context.WithTimeout( context.Background(), c.restClient.Config.RestTimeout )
+	c.Lock(); stale := c.state.ConnectResponse.StaleAccessToken || c.state.Exit != nil && c.state.Exit.StaleAccessToken; c.Unlock()
+	if !stale { return }																														// Access token is not stale
+	client := c.sessionClient()
+	if len( client.Config.AccessTokenPath ) == 0 { return }																						// Access token is not stored
+	log.Println( "AcRe: Updating the Access-Token in", client.Config.AccessTokenUpdateDelay )
+	time.AfterFunc( client.Config.AccessTokenUpdateDelay, func() {
+		ctx, cancel := context.WithTimeout( context.Background(), client.Config.RestTimeout )
 		defer cancel()
 		if notify { c.StateNotify( &State{ Code: TokenUpdate, Timestamp: time.Now() } ) }														// TokenUpdate is a notification
-		if accessToken, err := c.restClient.GetAccessToken( ctx ); err != nil { log.Println( "AcRe: [ERR] Access-Token update failed:", err ); return } else { c.Config.Rest.AccessToken = accessToken }
+		if accessToken, err := client.GetAccessToken( ctx ); err != nil { log.Println( "AcRe: [ERR] Access-Token update failed:", err ); return } else { c.Config.Rest.AccessToken = accessToken }
 		log.Println( "AcRe: Access-Token updated" )
 		if notify { c.StateNotify( &State{ Code: TokenUpdateDone, Timestamp: time.Now() } ) }													// TokenUpdateDone is a notification
 	})
@@ -257,14 +301,12 @@ func ( c *Connection ) AccessTokenFetch( notify bool ) ( accessToken string, err
 	
 	newRestConfig := *c.Config.Rest																												// Duplicate config since ExternalIps changes Port, CA and Host fields
 	client := rest.New( &newRestConfig )																										// Create a REST client (must be a new one since externalIps changes client's configuration)
-	dohResolver := doh.New( c.Config.DoH )																										// Create a DoH resolver
-	if c.state.Code == Connected { newRestConfig.UseDoH = false } else { dohResolver.Init(); client.SetDohResolver( dohResolver ) }				// Disable DoH when connected (tunnel secures DNS), initialize and attach the DoHResolver otherwise
-	
-	plainResolver := plain.New( c.Config.Plain )																								// Create a Plain resolver (fallback)
-	if err = plainResolver.Init(); err != nil { log.Println( "AccessTokenFetch: [ERR] Plain resolver failed:", err ); return }					// Initialize Plain resolver
-	client.SetPlainResolver( plainResolver )																									// Attach the Plain resolver
-	
-	if c.state.Code == Routed { dohResolver.SetRouteOps( c.link ); plainResolver.SetRouteOps( c.link ) }										// DoH or Plain resolution throw routes required when leak protection mode active in routed state
+	if c.state.Code == Connected { newRestConfig.UseDoH, newRestConfig.UseDnsCrypt = false, false }											// Disable DoH and DNSCrypt when connected (tunnel secures DNS)
+	routeOps := resolvers.RouteOps( nil )
+	if c.state.Code == Routed { routeOps = c.link; client.SetRouteOps( c.link ) }																// Resolution and REST throw routes required when leak protection mode active in routed state
+	named, err := c.Config.NewResolvers( &newRestConfig, routeOps )
+	if err != nil { log.Println( "AcFe: [ERR] Resolvers failed:", err ); return }
+	client.SetResolvers( named )
 	
 	if err = client.Init(); err != nil { log.Println( "AcFe: REST client failed:", err ); return }
 	ctx, cancel := context.WithTimeout( context.Background(), c.Config.Rest.RestTimeout )
@@ -279,20 +321,22 @@ func ( c *Connection ) AccessTokenFetch( notify bool ) ( accessToken string, err
 }
 
 func ( c *Connection ) Filter() {
-	if c.restClient.Config.Filter.Empty() { return }
-	ctx, cancel := context.WithTimeout( context.Background(), c.restClient.Config.RestTimeout )
+	client := c.sessionClient()																													// Filters apply to the traffic leaving the exit server when multi-hop
+	if client.Config.Filter.Empty() { return }
+	ctx, cancel := context.WithTimeout( context.Background(), client.Config.RestTimeout )
 	defer cancel()
-	switch err := c.restClient.ApplyFilter( ctx ); err {
-		case nil: log.Println( "Fltr: Filters (", c.restClient.Config.Filter.String(),") applied" )
-		default:  log.Println( "Fltr: Filters (", c.restClient.Config.Filter.String(), ") have not been applied:", err )
+	switch err := client.ApplyFilter( ctx ); err {
+		case nil: log.Println( "Fltr: Filters (", client.Config.Filter.String(),") applied" )
+		default:  log.Println( "Fltr: Filters (", client.Config.Filter.String(), ") have not been applied:", err )
 	}
 }
 
 func ( c *Connection ) PortForward() {
-	if !c.restClient.Config.PortForward.Enabled { return }
-	ctx, cancel := context.WithTimeout( context.Background(), c.restClient.Config.RestTimeout )
+	client := c.sessionClient()																													// Ports get forwarded by the exit server when multi-hop
+	if !client.Config.PortForward.Enabled { return }
+	ctx, cancel := context.WithTimeout( context.Background(), client.Config.RestTimeout )
 	defer cancel()
-	switch err := c.restClient.EnablePortForwarding( ctx ); err {
+	switch err := client.EnablePortForwarding( ctx ); err {
 		case nil: log.Println( "PFwd: Port-Forwarding enabled" )
 		default:  log.Println( "PFwd: Port-Forwarding has not been enabled:", err )
 	}
@@ -303,15 +347,13 @@ func ( c *Connection ) ExternalIPs() ( err error ) {
 	
 	newRestConfig := *c.Config.Rest																													// Duplicate config since ExternalIps changes Port, CA and Host fields
 	client := rest.New( &newRestConfig )																											// Create a REST client (must be a new one since externalIps changes client's configuration)
-	dohResolver := doh.New( c.Config.DoH )																											// Create a DoH resolver
-	if c.state.Code == Connected { newRestConfig.UseDoH = false } else { dohResolver.Init(); client.SetDohResolver( dohResolver ) }					// Disable DoH when connected (tunnel secures DNS), initialize and attach the DoHResolver otherwise
-
-	plainResolver := plain.New( c.Config.Plain )																									// Create a Plain resolver (fallback)
-	if err = plainResolver.Init(); err != nil { log.Println( "ExIP: [ERR] Plain resolver failed:", err ); return }									// Initialize the Plain resolver
-	client.SetPlainResolver( plainResolver )																										// Attach the Plain resolver
+	if c.state.Code == Connected { newRestConfig.UseDoH, newRestConfig.UseDnsCrypt = false, false }												// Disable DoH and DNSCrypt when connected (tunnel secures DNS)
 
-	code, mark, link := c.state.Code, 0, ( *wireguard.Link )( nil )																					// Snapshot code to make sure we remove throw routes even when state changes to something like clean or connected
-	if code == Routed { dohResolver.SetRouteOps( c.link ); plainResolver.SetRouteOps( c.link ); mark, link = c.link.Config.Mark, c.link }			// DoH or Plain resolution throw routes required when leak protection mode active in routed state
+	code, mark, link, routeOps := c.state.Code, 0, ( *wireguard.Link )( nil ), resolvers.RouteOps( nil )											// Snapshot code to make sure we remove throw routes even when state changes to something like clean or connected
+	if code == Routed { routeOps = c.link; client.SetRouteOps( c.link ); mark, link = c.link.Config.Mark, c.link }									// Resolution and REST throw routes required when leak protection mode active in routed state
+	named, err := c.Config.NewResolvers( &newRestConfig, routeOps )
+	if err != nil { log.Println( "ExIP: [ERR] Resolvers failed:", err ); return }
+	client.SetResolvers( named )
 
 	c.state.ExternalIpv4, c.state.ExternalIpv6 = nil, nil																							// Clear previously discovered external IPs
 	go func() {
@@ -340,17 +382,46 @@ func ( c *Connection ) ExternalIPs() ( err error ) {
 	return
 }
 
+// DnsCheck verifies that DNS goes through the tunnel and stores the result in the state
+func ( c *Connection ) DnsCheck( notify bool ) ( check *wireguard.DnsCheck, err error ) {
+	c.Lock()
+	if c.state.Code != Connected { c.Unlock(); err = errors.New( "not connected" ); return }
+	dnsLink := c.link																																// DNS is configured on the exit link when multi-hop
+	if c.exitLink != nil { dnsLink = c.exitLink }
+	c.Unlock()
+
+	ctx, cancel := context.WithTimeout( context.Background(), time.Second * 10 )
+	defer cancel()
+	check = dnsLink.DnsCheck( ctx )
+	if check.Passed { log.Println( "DnsC: Passed" ) } else { log.Println( "DnsC: [WARN] Failed, DNS may leak" ) }
+	
+	c.Lock(); defer c.Unlock()
+	if c.state.Code != Connected { err = errors.New( "disconnected during the check" ); return }
+	c.state.DnsCheck = check
+	if notify {
+		oldStateCode := c.state.Code
+		c.state.Code = DnsCheck
+		c.StateNotify( c.state )																													// Send the new state
+		c.state.Code = oldStateCode
+	}
+	return
+}
+
 func ( c *Connection ) DPD() {
 	c.Lock()
 	currentRx, err := c.link.GetRx()
 	if err != nil { c.Unlock(); log.Println( "DPD: Failed:", err.Error() ); c.Disconnect( true ); return }											// There won't be any reconnect attempts when a link fails, so notify about the disconnect
-	if currentRx != c.lastRx {																														// RX counter changed, link is alive
-		c.lastRx = currentRx
+	currentExitRx := int64( 0 )
+	if c.exitLink != nil {																															// Multi-hop exit link carries its own peer, which may die while the entry peer stays alive
+		if currentExitRx, err = c.exitLink.GetRx(); err != nil { c.Unlock(); log.Println( "DPD: Exit link failed:", err.Error() ); c.Disconnect( true ); return }
+	}
+	if currentRx != c.lastRx && ( c.exitLink == nil || currentExitRx != c.lastExitRx ) {															// RX counters changed, links are alive
+		c.lastRx, c.lastExitRx = currentRx, currentExitRx
 		c.dpdTimer.Reset( c.link.Config.DpdTimeout )
 		c.Unlock()
 		return
 	}
-	c.lastRx = 0																																	// Link is not alive, reset the counter
+	c.lastRx, c.lastExitRx = 0, 0																													// Links are not alive, reset the counters
 	c.StateNotify( c.state.SetCode( DpdTimeout ) )
 	c.Unlock()
 	log.Println( "DPD: Timeout" )
@@ -0,0 +1,66 @@
+package connection
+
+import (
+	"context"
+	"log"
+	"net/url"
+
+	"github.com/eventure/hide.client.linux/rest"
+	"github.com/eventure/hide.client.linux/wireguard"
+)
+
+// exitResolve creates a REST client for the multi-hop exit server and resolves the exit server's address while the entry tunnel is still down
+func ( c *Connection ) exitResolve( ctx context.Context ) ( exitClient *rest.Client, err error ) {
+	exitConfig := *c.Config.Rest																												// The exit server shares all the REST settings with the entry server, except the host
+	exitConfig.SetHost( c.Config.Rest.ExitHost )
+	exitConfig.ExitHost = ""
+	exitClient = rest.New( &exitConfig )
+	if err = exitClient.Init(); err != nil { log.Println( "Exit: [ERR] REST Client setup failed:", err ); return }
+	exitClient.SetResolvers( c.resolvers )
+	exitClient.SetInTunnel( true )																												// Exit server requests go through the entry tunnel, so its addresses must not be probed directly
+	if err = exitClient.Resolve( ctx ); err != nil { log.Println( "Exit: [ERR] Resolve", exitConfig.Host, "failed" ); return }
+	return
+}
+
+// connectExit connects to the multi-hop exit server through the entry link and brings the exit link up. Must be called with the Connection locked
+func ( c *Connection ) connectExit( exitClient *rest.Client ) ( err error ) {
+	ctx, cancel := context.WithTimeout( context.Background(), exitClient.Config.RestTimeout )
+	defer cancel()
+
+	exitIpNet := wireguard.Ip2Net( exitClient.Remote().IP )
+	if err = c.link.HopRouteAdd( "Exit server", exitIpNet ); err != nil { return }																// Route the exit server's REST endpoint through the entry tunnel
+	c.connectStack = append( c.connectStack, func() { _ = c.link.HopRouteDel( "Exit server", exitIpNet ) } )
+
+	exitLinkConfig := *c.Config.WireGuard																										// Exit link shares the routing table with the entry link, but it must not mark its traffic
+	exitLinkConfig.Name, exitLinkConfig.Mark, exitLinkConfig.ListenPort, exitLinkConfig.PrivateKey = c.Config.WireGuard.ExitName, 0, 0, ""
+	exitLink := wireguard.New( &exitLinkConfig )
+	if err = exitLink.Open(); err != nil { log.Println( "Exit: [ERR] Wireguard open failed:", err ); return }
+	c.connectStack = append( c.connectStack, exitLink.Close )
+	exitLink.SetUnderlay( c.link )
+	exitLink.SetDnsForwarder( c.dnsForwarder )
+	c.exitLink = exitLink
+
+	log.Println( "Exit: Connecting to", exitIpNet.IP, "through", c.link.Config.Name )
+	exitResponse, err := exitClient.Connect( ctx, exitLink.PublicKey() )																		// Issue a REST Connect request to the exit server
+	if err != nil { if urlError, ok := err.( *url.Error ); ok { err = urlError.Unwrap() }; log.Println( "Exit: [ERR] REST failed:", err.Error() ); return }
+	exitResponse.Print()
+	c.state.Exit, c.state.ExitPin = exitResponse, exitClient.MatchedPin()
+	c.exitClient = exitClient																													// Session requests ( Access-Token, filters, port-forwarding ) go to the exit server
+	c.connectStack = append( c.connectStack, func() {																							// Exit session gets disconnected first, while the entry tunnel is still up
+		ctx, cancel := context.WithTimeout( context.Background(), exitClient.Config.RestTimeout )
+		defer cancel()
+		switch err := exitClient.Disconnect( ctx, exitResponse.SessionToken ); err {
+			case nil: log.Println( "Exit: Disconnected" )
+			default:  log.Println( "Exit: [ERR] Disconnect POST failed:", err )
+		}
+	})
+
+	if endpointIpNet := wireguard.Ip2Net( exitResponse.Endpoint.IP ); !endpointIpNet.IP.Equal( exitIpNet.IP ) {								// WireGuard endpoint of the exit server may differ from its REST endpoint
+		if err = c.link.HopRouteAdd( "Exit endpoint", endpointIpNet ); err != nil { return }
+		c.connectStack = append( c.connectStack, func() { _ = c.link.HopRouteDel( "Exit endpoint", endpointIpNet ) } )
+	}
+
+	if err = exitLink.Up( exitResponse ); err != nil { log.Println( "Exit: [ERR] Link up failed:", err ); return }								// Default routes and DNS get configured on the exit link
+	c.connectStack = append( c.connectStack, exitLink.Down )
+	return
+}
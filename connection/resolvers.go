@@ -0,0 +1,63 @@
+package connection
+
+import (
+	"log"
+
+	"github.com/eventure/hide.client.linux/resolvers"
+	"github.com/eventure/hide.client.linux/resolvers/dnscrypt"
+	"github.com/eventure/hide.client.linux/resolvers/doh"
+	"github.com/eventure/hide.client.linux/resolvers/plain"
+	"github.com/eventure/hide.client.linux/rest"
+	"github.com/eventure/hide.client.linux/wireguard"
+)
+
+// NewResolvers creates and initializes the resolvers of restConfig's resolver chain. When routeOps is not nil the resolvers add throw routes towards the servers they use
+func ( c *Config ) NewResolvers( restConfig *rest.Config, routeOps resolvers.RouteOps ) ( named map[string]resolvers.Resolver, err error ) {
+	names := restConfig.Resolvers
+	if len( names ) == 0 { names = resolvers.DefaultChain }
+	if err = resolvers.Check( names ); err != nil { log.Println( "Init: [ERR] Resolver chain:", err ); return }
+	
+	named = map[string]resolvers.Resolver{}
+	for _, name := range names {
+		switch name {
+			case resolvers.DoH:
+				if !restConfig.UseDoH { continue }
+				dohResolver := doh.New( c.DoH )
+				dohResolver.Init()
+				if routeOps != nil { dohResolver.SetRouteOps( routeOps ) }
+				named[name] = dohResolver
+			case resolvers.DnsCrypt:
+				if !restConfig.UseDnsCrypt { continue }
+				dnsCryptResolver := dnscrypt.New( c.DnsCrypt )
+				if err = dnsCryptResolver.Init(); err != nil { log.Println( "Init: [ERR] DNSCrypt resolver failed:", err ); return }
+				if routeOps != nil { dnsCryptResolver.SetRouteOps( routeOps ) }
+				named[name] = dnsCryptResolver
+			case resolvers.Plain:
+				plainResolver := plain.New( c.Plain )
+				if err = plainResolver.Init(); err != nil { log.Println( "Init: [ERR] Plain resolver failed:", err ); return }
+				if routeOps != nil { plainResolver.SetRouteOps( routeOps ) }
+				switch link, ok := routeOps.( *wireguard.Link ); {															// The "system" servers come from resolv.conf as it was before the tunnel DNS got applied
+					case ok:	plainResolver.SetResolvConf( link.OriginalResolvConf )
+					default:	plainResolver.SetResolvConf( wireguard.New( c.WireGuard ).OriginalResolvConf )					// Another instance may be connected
+				}
+				named[name] = plainResolver
+			case resolvers.Hosts:
+				if len( restConfig.Hosts ) == 0 { continue }
+				named[name] = resolvers.HostMap( restConfig.Hosts )
+			case resolvers.Cache:
+				if len( restConfig.EndpointCachePath ) == 0 { continue }
+				named[name] = &resolvers.EndpointCache{ Filename: restConfig.EndpointCachePath }
+		}																																		// The previous lookup is provided by the REST client itself
+	}
+	return
+}
+
+// ReloadResolvers makes the resolvers of the resolver chain re-read their server lists, e.g. after a resolver list update
+func ( c *Connection ) ReloadResolvers() {
+	c.Lock(); named := c.resolvers; c.Unlock()
+	for name, resolver := range named {
+		reloader, ok := resolver.( resolvers.Reloader )
+		if !ok { continue }
+		if err := reloader.Reload(); err != nil { log.Println( "dUpd: [ERR] Reload of the", name, "resolver failed:", err ) }
+	}
+}
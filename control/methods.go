@@ -14,8 +14,6 @@ import (
 	"time"
 	
 	"github.com/eventure/hide.client.linux/connection"
-	"github.com/eventure/hide.client.linux/resolvers/doh"
-	"github.com/eventure/hide.client.linux/resolvers/plain"
 	"github.com/eventure/hide.client.linux/rest"
 )
 
@@ -25,6 +23,7 @@ const (
 	CodeConnect = "connect"
 	CodeDisconnect = "disconnect"
 	CodeToken = "token"
+	CodeDnsCheck = "dnscheck"
 )
 
 func ( s *Server ) configuration( writer http.ResponseWriter, request *http.Request ) {
@@ -246,13 +245,9 @@ func ( s *Server ) serverList(writer http.ResponseWriter, request *http.Request
 	
 	client := rest.New( s.connection.Config.Rest )																										// Create a REST client ( must be a new one since FetchServerList changes client's configuration )
 	
-	dohResolver := doh.New( s.connection.Config.DoH )																									// Create a DoH resolver
-	dohResolver.Init()
-	client.SetDohResolver(dohResolver)
-	
-	plainResolver := plain.New( s.connection.Config.Plain )																								// Create a Plain resolver
-	if err := plainResolver.Init(); err != nil { log.Println( "sLst: [ERR] Plain resolver init failed", err ); http.Error( writer, err.Error(), http.StatusBadGateway ); return }
-	client.SetPlainResolver(plainResolver)
+	named, err := s.connection.Config.NewResolvers( s.connection.Config.Rest, nil )																	// Create the resolvers of the resolver chain
+	if err != nil { log.Println( "sLst: [ERR] Resolvers init failed", err ); http.Error( writer, err.Error(), http.StatusBadGateway ); return }
+	client.SetResolvers( named )
 	
 	ctx, cancel := context.WithTimeout( context.Background(), s.connection.Config.Rest.RestTimeout )
 	defer cancel()
@@ -290,6 +285,20 @@ func ( s *Server ) externalIps(writer http.ResponseWriter, request *http.Request
 	log.Println( "exIP: Async external IP lookup started" )
 }
 
+func ( s *Server ) dnsCheck( writer http.ResponseWriter, request *http.Request ) {
+	if request.Method != "GET" { http.Error( writer, http.StatusText( http.StatusNotFound ), http.StatusNotFound ); return }
+	select {
+		case s.connectionOpsLock<-struct{}{}: defer func() { <-s.connectionOpsLock }(); break
+		case <-time.NewTimer( time.Second ).C: http.Error( writer, http.StatusText( http.StatusConflict ), http.StatusConflict ); return
+	}
+	
+	log.Println( "dnsC: Performing the DNS leak check" )
+	writer.Header().Add( "content-type", "application/json" )
+	check, err := s.connection.DnsCheck( true )
+	if err != nil { writer.Write( Result{ Error: &Error{ Code: CodeDnsCheck, Message: err.Error() } }.Json() ); return }
+	writer.Write( Result{ Result: check }.Json() )
+}
+
 func ( s *Server ) version(writer http.ResponseWriter, request *http.Request ) {
 	writer.Header().Add( "content-type", "application/json" )
 	log.Println( "vers: Sending version", "0.9.12" )
@@ -5,12 +5,14 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync/atomic"
 	"time"
 	
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/eventure/hide.client.linux/connection"
+	"github.com/eventure/hide.client.linux/resolvers/doh"
 )
 
 type Config struct {
@@ -30,6 +32,7 @@ type Server struct {
 
 	serverListBytes		atomic.Pointer[[]byte]
 	serverListTimer		*time.Timer
+	resolversTimer		*time.Timer
 
 	connectionOpsLock	chan struct{}
 }
@@ -67,6 +70,7 @@ func ( s *Server ) Init() ( err error ) {
 	mux.HandleFunc( "/log", s.log )
 	mux.HandleFunc( "/serverList", s.serverList )
 	mux.HandleFunc( "/externalIps", s.externalIps )
+	mux.HandleFunc( "/dnscheck", s.dnsCheck )
 	mux.HandleFunc( "/version", s.version )
 	s.server = &http.Server{ Handler: mux, ReadHeaderTimeout: time.Second * 5 }
 	
@@ -75,6 +79,8 @@ func ( s *Server ) Init() ( err error ) {
 		log.SetOutput( NewRingLog( s.Config.LineLogBufferSize, log.Writer() ) )
 	}
 	
+	s.scheduleResolversUpdate()
+	
 	if supported, err := daemon.SdNotify( false, daemon.SdNotifyReady ); supported && err != nil {														// Send SystemD ready notification
 		log.Println( "Init: [ERR] SystemD notification failed:", err )
 	}
@@ -96,7 +102,24 @@ func ( s *Server ) Serve() ( err error ) {
 	return
 }
 
+// scheduleResolversUpdate updates the DoH resolver list periodically. A list which is missing or older than the update interval gets updated shortly after the start
+func ( s *Server ) scheduleResolversUpdate() {
+	dohConfig := s.connection.Config.DoH
+	if dohConfig == nil || dohConfig.UpdateInterval <= 0 || len( dohConfig.Filename ) == 0 { return }
+	delay := dohConfig.UpdateInterval
+	if info, err := os.Stat( dohConfig.Filename ); err != nil || time.Since( info.ModTime() ) > delay { delay = time.Minute }
+	log.Println( "dUpd: Next resolvers update in", delay )
+	s.resolversTimer = time.AfterFunc( delay, func() {
+		switch err := doh.New( dohConfig ).Update(); err {
+			case nil:	s.connection.ReloadResolvers()																								// The live resolvers pick up the updated list
+			default:	log.Println( "dUpd: [ERR] Periodic resolvers update failed:", err )
+		}
+		s.scheduleResolversUpdate()
+	})
+}
+
 func ( s *Server ) Shutdown() error {
+	if s.resolversTimer != nil { s.resolversTimer.Stop() }
 	s.connection.Disconnect( false )
 	s.connection.Shutdown( true )
 	return s.server.Close()
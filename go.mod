@@ -4,6 +4,7 @@ go 1.24.0
 
 require (
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/jedisct1/go-dnsstamps v0.0.0-20240423203910-07a0735c7774
 	github.com/spf13/pflag v1.0.7
 	github.com/vishvananda/netlink v1.3.0
@@ -6,12 +6,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/eventure/hide.client.linux/connection"
 	"github.com/eventure/hide.client.linux/control"
+	"github.com/eventure/hide.client.linux/resolvers"
 	"github.com/eventure/hide.client.linux/resolvers/doh"
-	"github.com/eventure/hide.client.linux/resolvers/plain"
 	"github.com/eventure/hide.client.linux/rest"
+	"github.com/eventure/hide.client.linux/wireguard"
 	flag "github.com/spf13/pflag"
 )
 
@@ -23,13 +25,9 @@ func accessToken( conf *Configuration ) ( err error ) {
 	if !client.HaveAccessToken() {																											// An old Access-Token may be used to obtain a new one, although that process may be done by "connect" too
 		if err = client.InteractiveCredentials(); err != nil { log.Println( "AcTo: [ERR] Credential error:", err ); return }				// Try to obtain credentials through the terminal
 	}
-	dohResolver := doh.New(conf.DoH)
-	dohResolver.Init()
-	client.SetDohResolver(dohResolver)
-	
-	plainResolver := plain.New(conf.Plain)
-	if err = plainResolver.Init(); err != nil { log.Println( "AcTo: [ERR] Plain resolver init failed", err ); return }
-	client.SetPlainResolver(plainResolver)
+	named, err := conf.NewResolvers( conf.Rest, nil )																						// Create the resolvers of the resolver chain
+	if err != nil { log.Println( "AcTo: [ERR] Resolvers init failed", err ); return }
+	client.SetResolvers( named )
 	
 	ctx, cancel := context.WithTimeout( context.Background(), conf.Rest.RestTimeout )
 	defer cancel()
@@ -43,29 +41,25 @@ func accessToken( conf *Configuration ) ( err error ) {
 func categories( conf *Configuration ) {
 	client := rest.New( conf.Rest )																											// Create the REST client
 	
-	dohResolver := doh.New(conf.DoH)
-	dohResolver.Init()
-	client.SetDohResolver(dohResolver)
-	
-	plainResolver := plain.New(conf.Plain)
-	if err := plainResolver.Init(); err != nil { log.Println( "Cats: [ERR] Plain resolver init failed", err ); return }
-	client.SetPlainResolver(plainResolver)
+	named, err := conf.NewResolvers( conf.Rest, nil )																						// Create the resolvers of the resolver chain
+	if err != nil { log.Println( "Cats: [ERR] Resolvers init failed", err ); return }
+	client.SetResolvers( named )
 	
 	ctx, cancel := context.WithTimeout( context.Background(), conf.Rest.RestTimeout )
 	defer cancel()
-	if err := client.FetchCategoryList( ctx ); err != nil { log.Println( "Cats: [ERR] GET request failed:", err ); return }					// Get JSON
+	categories, err := client.FetchCategoryList( ctx )																						// Get JSON
+	if err != nil { log.Println( "Cats: [ERR] GET request failed:", err ); return }
+	log.Printf( "%40s | %s\n", "CATEGORY", "DESCRIPTION" )
+	log.Printf( "%40s | %s\n", "--------", "-----------" )
+	for _, category := range categories { log.Printf( "%40s | %s\n", category.Name, category.Description ) }
 }
 
 func serverList( conf *Configuration, kind string ) {
 	client := rest.New( conf.Rest )																											// Create the REST client
 	
-	dohResolver := doh.New(conf.DoH)																										// Create a DoH resolver
-	dohResolver.Init()
-	client.SetDohResolver(dohResolver)
-	
-	plainResolver := plain.New(conf.Plain)																									// Create a Plain resolver
-	if err := plainResolver.Init(); err != nil { log.Println( "List: [ERR] Plain resolver init failed", err ); return }
-	client.SetPlainResolver(plainResolver)
+	named, err := conf.NewResolvers( conf.Rest, nil )																						// Create the resolvers of the resolver chain
+	if err != nil { log.Println( "List: [ERR] Resolvers init failed", err ); return }
+	client.SetResolvers( named )
 	
 	ctx, cancel := context.WithTimeout( context.Background(), conf.Rest.RestTimeout )
 	defer cancel()
@@ -106,24 +100,55 @@ func main() {
 			if err = dohResolver.Update(); err != nil { log.Println( "Main: [ERR] Resolvers update failed:", err ); return }
 			log.Println( "Main: Resolvers updated" )
 			return
-		case "resolve":
-			if len( flag.Arg(1) ) == 0 { flag.Usage(); return }
-			dohResolver := doh.New( conf.DoH )
-			dohResolver.Init()
-			switch ips, err := dohResolver.Resolve( context.Background(), flag.Arg(1) ); err {
-				case nil:	log.Println( "Main: Resolved", flag.Arg(1), "to", ips )
-				default:	log.Println( "Main: Resolve", flag.Arg(1), "failed:", err )
+		case "doh":
+			switch flag.Arg(1) {
+				case "stats":																													// Show the DoH server health statistics
+					dohResolver := doh.New( conf.DoH )
+					dohResolver.Init()
+					dohResolver.PrintStats()
+				default: flag.Usage()
 			}
 			return
-		case "lookup":
+		case "resolve", "lookup":																											// Resolve using the resolver chain ( or the resolvers listed after the host ), lookup uses plain DNS only
 			if len( flag.Arg(1) ) == 0 { flag.Usage(); return }
-			plainResolver := plain.New( conf.Plain )
-			if err = plainResolver.Init(); err != nil { log.Println( "Main: [ERR] Plain resolver init failed", err ); return }
-			switch ips, err := plainResolver.Resolve( context.Background(), flag.Arg(1) ); err {
+			chainConfig := *conf.Rest
+			switch {
+				case flag.Arg(0) == "lookup":	chainConfig.Resolvers = []string{ resolvers.Plain }
+				case flag.NArg() > 2:			chainConfig.Resolvers, chainConfig.UseDoH, chainConfig.UseDnsCrypt = flag.Args()[2:], true, true
+			}
+			named, err := conf.NewResolvers( &chainConfig, nil )
+			if err != nil { log.Println( "Main: [ERR] Resolvers init failed", err ); return }
+			chain := &resolvers.Chain{ Names: chainConfig.Resolvers, Resolvers: named }
+			if len( chain.Names ) == 0 { chain.Names = resolvers.DefaultChain }
+			switch ips, err := chain.Resolve( context.Background(), flag.Arg(1) ); err {
 				case nil:	log.Println( "Main: Resolved", flag.Arg(1), "to", ips )
 				default:	log.Println( "Main: Resolve", flag.Arg(1), "failed:", err )
 			}
 			return
+		case "dnscheck":																														// Check the DNS of an already established connection for leaks
+			linkConfig := *conf.WireGuard
+			if len( conf.Rest.ExitHost ) > 0 { linkConfig.Name = conf.WireGuard.ExitName }																// Multi-hop DNS travels through the exit link
+			link := wireguard.New( &linkConfig )
+			if err = link.Attach(); err != nil { log.Println( "Main: [ERR] DNS check failed:", err ); return }
+			ctx, cancel := context.WithTimeout( context.Background(), time.Second * 10 )
+			check := link.DnsCheck( ctx )
+			cancel()
+			for _, item := range check.Items {
+				if item.Passed { log.Println( "Main:", item.Name, "passed", item.Detail ) } else { log.Println( "Main: [ERR]", item.Name, "failed:", item.Detail ) }
+			}
+			if check.Passed { log.Println( "Main: DNS check passed" ) } else { log.Println( "Main: [ERR] DNS check failed, DNS may leak" ) }
+			return
+		case "pins":
+			switch flag.Arg(1) {
+				case "update":																													// Download and verify the pin-set file
+					ctx, cancel := context.WithTimeout( context.Background(), conf.Rest.RestTimeout )
+					err = rest.New( conf.Rest ).UpdatePinFile( ctx )
+					cancel()
+					if err != nil { log.Println( "Main: [ERR] Pin-set update failed:", err ); return }
+				case "":		conf.Rest.Pins.Print()
+				default:		flag.Usage()
+			}
+			return
 		case "list":
 			switch flag.Arg(1) {
 				case "free":	serverList( conf, "free" )
@@ -0,0 +1,54 @@
+// Package minisign verifies minisign signatures
+package minisign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var ErrBadSignature = errors.New( "bad minisign signature" )
+
+// Key is a decoded minisign public key: signature-algorithm(2) || key-id(8) || ed25519-public-key(32)
+type Key struct {
+	id			[8]byte
+	publicKey	ed25519.PublicKey
+}
+
+// ParseKey parses a base64 encoded minisign public key, the "untrusted comment" line of a public key file may be included
+func ParseKey( key string ) ( mKey *Key, err error ) {
+	lines := strings.Split( strings.TrimSpace( key ), "\n" )
+	bin, err := base64.StdEncoding.DecodeString( strings.TrimSpace( lines[len( lines ) - 1] ) )
+	if err != nil { return }
+	if len( bin ) != 42 || string( bin[:2] ) != "Ed" { err = errors.New( "bad minisign public key" ); return }
+	mKey = &Key{ publicKey: ed25519.PublicKey( bin[10:] ) }
+	copy( mKey.id[:], bin[2:10] )
+	return
+}
+
+// Verify checks a minisign signature of message. The signature file consists of an untrusted comment, the signature, a trusted comment and the global signature of the signature and the trusted comment
+func ( k *Key ) Verify( message, signature []byte ) ( err error ) {
+	lines := strings.Split( strings.ReplaceAll( strings.TrimSpace( string( signature ) ), "\r", "" ), "\n" )
+	if len( lines ) < 4 || !strings.HasPrefix( lines[2], "trusted comment: " ) { return errors.New( "bad minisign signature format" ) }
+	bin, err := base64.StdEncoding.DecodeString( lines[1] )																		// signature-algorithm(2) || key-id(8) || signature(64)
+	if err != nil { return }
+	if len( bin ) != 74 { return errors.New( "bad minisign signature length" ) }
+	if !bytes.Equal( bin[2:10], k.id[:] ) { return errors.New( "minisign signature made by another key" ) }
+	switch string( bin[:2] ) {
+		case "Ed":																												// Legacy signature of the message itself
+		case "ED":																												// Signature of the BLAKE2b-512 hash of the message
+			digest := blake2b.Sum512( message )
+			message = digest[:]
+		default: return errors.New( "unsupported minisign signature algorithm" )
+	}
+	if !ed25519.Verify( k.publicKey, message, bin[10:] ) { return ErrBadSignature }
+	
+	globalSignature, err := base64.StdEncoding.DecodeString( lines[3] )
+	if err != nil { return }
+	if !ed25519.Verify( k.publicKey, append( bin[10:74:74], strings.TrimPrefix( lines[2], "trusted comment: " )... ), globalSignature ) { return ErrBadSignature }	// Trusted comment is signed along with the signature
+	return
+}
@@ -0,0 +1,76 @@
+package resolvers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	
+	"github.com/eventure/hide.client.linux/atomicfile"
+)
+
+const (
+	maxCacheEntries = 64																					// The cache holds the most recently resolved names only
+	cacheRefresh = 24 * time.Hour																			// Unchanged entries get rewritten once this old, to keep them from being dropped as the least recently resolved
+)
+
+var cacheLock sync.Mutex																					// Serializes the cache file updates of all the REST clients
+
+type cacheEntry struct {
+	IPs			[]net.IP	`json:"ips"`
+	Verified	bool		`json:"verified,omitempty"`															// Whether the addresses have been verified through the dash-encoded names
+	Resolved	time.Time	`json:"resolved"`
+}
+
+// EndpointCache persists the addresses of successful lookups. Stale entries are kept, the cache is meant as the last resort on a fresh start when DNS is blocked
+type EndpointCache struct {
+	Filename	string
+}
+
+func ( c *EndpointCache ) load() ( entries map[string]*cacheEntry ) {
+	entries = map[string]*cacheEntry{}
+	content, err := os.ReadFile( c.Filename )
+	if err != nil { if !errors.Is( err, os.ErrNotExist ) { log.Println( "Name: [ERR] Read endpoint cache", c.Filename, "failed:", err ) }; return }
+	if err = json.Unmarshal( content, &entries ); err != nil { log.Println( "Name: [ERR] Parse endpoint cache", c.Filename, "failed:", err ); return map[string]*cacheEntry{} }
+	return
+}
+
+func ( c *EndpointCache ) Resolve( ctx context.Context, name string ) ( ips []net.IP, err error ) {
+	ips, _, err = c.ResolveVerified( ctx, name )
+	return
+}
+
+// ResolveVerified returns the cached addresses of name along with the verification result recorded when those were resolved
+func ( c *EndpointCache ) ResolveVerified( _ context.Context, name string ) ( ips []net.IP, verified bool, err error ) {
+	if len( c.Filename ) == 0 { return nil, false, errors.New( "no endpoint cache configured" ) }
+	cacheLock.Lock(); defer cacheLock.Unlock()
+	entry, ok := c.load()[strings.ToLower( strings.TrimSuffix( name, "." ) )]
+	if !ok || len( entry.IPs ) == 0 { return nil, false, errors.New( "not cached" ) }
+	state := "unverified"
+	if entry.Verified { state = "verified" }
+	log.Println( "Name: Using the", state, "addresses of", name, "resolved at", entry.Resolved.Format( time.RFC3339 ) )
+	return entry.IPs, entry.Verified, nil
+}
+
+// Store records the addresses of name, the least recently resolved entries get dropped when the cache is full. The file gets replaced atomically and only when the entry changed
+func ( c *EndpointCache ) Store( name string, ips []net.IP, verified bool ) {
+	if len( c.Filename ) == 0 || len( ips ) == 0 { return }
+	cacheLock.Lock(); defer cacheLock.Unlock()
+	entries, key := c.load(), strings.ToLower( strings.TrimSuffix( name, "." ) )
+	if entry, ok := entries[key]; ok && entry.Verified == verified && slices.EqualFunc( entry.IPs, ips, net.IP.Equal ) && time.Since( entry.Resolved ) < cacheRefresh { return }	// Nothing changed
+	entries[key] = &cacheEntry{ IPs: ips, Verified: verified, Resolved: time.Now() }
+	for len( entries ) > maxCacheEntries {
+		oldest := ""
+		for host, entry := range entries { if len( oldest ) == 0 || entry.Resolved.Before( entries[oldest].Resolved ) { oldest = host } }
+		delete( entries, oldest )
+	}
+	content, err := json.Marshal( entries )
+	if err != nil { return }
+	if err = atomicfile.Write( c.Filename, content ); err != nil { log.Println( "Name: [ERR] Write endpoint cache", c.Filename, "failed:", err ) }
+}
@@ -0,0 +1,90 @@
+package dnscrypt
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+const (
+	esXSalsa20Poly1305 = 0x0001																				// X25519-XSalsa20Poly1305 encryption system
+	esXChaCha20Poly1305 = 0x0002																			// X25519-XChacha20Poly1305 encryption system
+)
+
+var errOpen = errors.New( "decryption failed" )
+
+// sharedKey computes the key shared by the client and the resolver
+func sharedKey( esVersion uint16, clientSk, resolverPk *[32]byte ) ( key [32]byte, err error ) {
+	switch esVersion {
+		case esXSalsa20Poly1305:
+			box.Precompute( &key, resolverPk, clientSk )
+		case esXChaCha20Poly1305:																			// HChaCha20 of the X25519 shared secret, like libsodium's crypto_box_curve25519xchacha20poly1305_beforenm
+			dh, dhErr := curve25519.X25519( clientSk[:], resolverPk[:] )
+			if dhErr != nil { err = dhErr; return }
+			subKey, hErr := chacha20.HChaCha20( dh, make( []byte, 16 ) )
+			if hErr != nil { err = hErr; return }
+			copy( key[:], subKey )
+		default:
+			err = errors.New( "unsupported encryption system" )
+	}
+	return
+}
+
+// seal encrypts and authenticates a message, the tag precedes the ciphertext
+func seal( esVersion uint16, key *[32]byte, nonce *[24]byte, message []byte ) []byte {
+	if esVersion == esXSalsa20Poly1305 { return secretbox.Seal( nil, message, nonce, key ) }
+	stream, _ := chacha20.NewUnauthenticatedCipher( key[:], nonce[:] )										// XChaCha20 secretbox, the first 32 keystream bytes are the Poly1305 key
+	polyKey := [32]byte{}
+	stream.XORKeyStream( polyKey[:], polyKey[:] )
+	sealed := make( []byte, poly1305.TagSize + len( message ) )
+	stream.XORKeyStream( sealed[poly1305.TagSize:], message )
+	tag := [poly1305.TagSize]byte{}
+	poly1305.Sum( &tag, sealed[poly1305.TagSize:], &polyKey )
+	copy( sealed, tag[:] )
+	return sealed
+}
+
+// open verifies and decrypts a sealed message
+func open( esVersion uint16, key *[32]byte, nonce *[24]byte, sealed []byte ) ( message []byte, err error ) {
+	if len( sealed ) < poly1305.TagSize { return nil, errOpen }
+	if esVersion == esXSalsa20Poly1305 {
+		ok := false
+		if message, ok = secretbox.Open( nil, sealed, nonce, key ); !ok { return nil, errOpen }
+		return
+	}
+	stream, _ := chacha20.NewUnauthenticatedCipher( key[:], nonce[:] )
+	polyKey := [32]byte{}
+	stream.XORKeyStream( polyKey[:], polyKey[:] )
+	tag := [poly1305.TagSize]byte{}
+	poly1305.Sum( &tag, sealed[poly1305.TagSize:], &polyKey )
+	if subtle.ConstantTimeCompare( tag[:], sealed[:poly1305.TagSize] ) != 1 { return nil, errOpen }
+	message = make( []byte, len( sealed ) - poly1305.TagSize )
+	stream.XORKeyStream( message, sealed[poly1305.TagSize:] )
+	return
+}
+
+// pad appends the ISO/IEC 7816-4 padding, the padded length is a multiple of 64 and at least minLength
+func pad( message []byte, minLength int ) []byte {
+	length := max( minLength, ( len( message ) + 1 + 63 ) / 64 * 64 )
+	padded := make( []byte, length )
+	copy( padded, message )
+	padded[len( message )] = 0x80
+	return padded
+}
+
+// unpad removes the ISO/IEC 7816-4 padding
+func unpad( padded []byte ) ( message []byte, err error ) {
+	for i := len( padded ) - 1; i >= 0; i-- {
+		switch padded[i] {
+			case 0x00: continue
+			case 0x80: return padded[:i], nil
+			default: return nil, errors.New( "bad padding" )
+		}
+	}
+	return nil, errors.New( "bad padding" )
+}
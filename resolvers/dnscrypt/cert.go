@@ -0,0 +1,71 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var certMagic = []byte( "DNSC" )
+
+// certificate is a resolver certificate signed by the provider's key
+type certificate struct {
+	esVersion		uint16																											// Encryption system
+	resolverPk		[32]byte																										// Resolver's short-term public key
+	clientMagic		[8]byte																											// Query prefix
+	serial			uint32
+	notAfter		time.Time
+}
+
+func ( c *certificate ) valid() bool { return c != nil && time.Now().Before( c.notAfter ) }
+
+// parseCertificate parses a binary certificate and validates it against the provider's public key:
+// cert-magic(4) || es-version(2) || protocol-minor-version(2) || signature(64) || resolver-pk(32) || client-magic(8) || serial(4) || ts-start(4) || ts-end(4) || extensions
+func parseCertificate( bin []byte, providerPk []byte, now time.Time ) ( cert *certificate, err error ) {
+	if len( bin ) < 124 { err = errors.New( "certificate is too short" ); return }
+	if !bytes.Equal( bin[:4], certMagic ) { err = errors.New( "bad certificate magic" ); return }
+	esVersion := binary.BigEndian.Uint16( bin[4:6] )
+	if esVersion != esXSalsa20Poly1305 && esVersion != esXChaCha20Poly1305 { err = errors.New( "unsupported encryption system" ); return }
+	if len( providerPk ) != ed25519.PublicKeySize { err = errors.New( "bad provider public key" ); return }
+	if !ed25519.Verify( providerPk, bin[72:], bin[8:72] ) { err = errors.New( "bad certificate signature" ); return }
+
+	cert = &certificate{ esVersion: esVersion, serial: binary.BigEndian.Uint32( bin[112:116] ) }
+	copy( cert.resolverPk[:], bin[72:104] )
+	copy( cert.clientMagic[:], bin[104:112] )
+	notBefore := time.Unix( int64( binary.BigEndian.Uint32( bin[116:120] ) ), 0 )
+	cert.notAfter = time.Unix( int64( binary.BigEndian.Uint32( bin[120:124] ) ), 0 )
+	if now.Before( notBefore ) || now.After( cert.notAfter ) { return nil, errors.New( "certificate is not valid at this time" ) }
+	return
+}
+
+// fetchCertificate asks the resolver for its certificates and picks the valid one with the highest serial
+func ( r *Resolver ) fetchCertificate( ctx context.Context, s *server ) ( cert *certificate, err error ) {
+	providerName := s.stamp.ProviderName
+	if !strings.HasSuffix( providerName, "." ) { providerName += "." }
+	query, id, err := newQuery( providerName, dnsmessage.TypeTXT )
+	if err != nil { return }
+	response, err := r.transport( ctx, "udp", s.stamp.ServerAddrStr, query )
+	if err == nil && len( response ) > 2 && response[2] & 0x02 != 0 { response, err = r.transport( ctx, "tcp", s.stamp.ServerAddrStr, query ) }	// Truncated, retry over TCP
+	if err != nil { return }
+
+	msg := dnsmessage.Message{}
+	if err = msg.Unpack( response ); err != nil { return }
+	if !msg.Header.Response || msg.Header.ID != id { err = errors.New( "bad certificate response" ); return }
+	now := time.Now()
+	for _, answer := range msg.Answers {
+		txt, ok := answer.Body.( *dnsmessage.TXTResource )
+		if !ok { continue }
+		candidate, parseErr := parseCertificate( []byte( strings.Join( txt.TXT, "" ) ), s.stamp.ServerPk, now )
+		if parseErr != nil { log.Println( "DCry: [WARN] Certificate of", s.stamp.ProviderName, "rejected:", parseErr ); continue }
+		if cert == nil || candidate.serial > cert.serial || ( candidate.serial == cert.serial && candidate.esVersion > cert.esVersion ) { cert = candidate }	// XChaCha20 wins a tie
+	}
+	if cert == nil { err = errors.New( "no valid certificate" ) }
+	return
+}
@@ -0,0 +1,267 @@
+package dnscrypt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	mathRand "math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jedisct1/go-dnsstamps"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+var resolverMagic = []byte{ 0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38 }
+
+type RouteOps interface {
+	ThrowRouteAdd( logPrefix string, dst *net.IPNet ) ( err error )
+	ThrowRouteDel( logPrefix string, dst *net.IPNet ) ( err error )
+}
+
+type Config struct {
+	Servers		[]string		`yaml:"servers,omitempty"`										// DNSCrypt DNS stamps
+	Filename	string			`yaml:"filename,omitempty"`										// Resolver list ( DNS stamps ) to pick the DNSCrypt servers from
+}
+
+type server struct {
+	stamp		dnsstamps.ServerStamp
+	cert		*certificate																	// Current resolver certificate, fetched on first use
+}
+
+type Resolver struct {
+	*Config
+	sync.Mutex
+	servers		[]*server
+	dialer		*net.Dialer
+	mark		int
+	routeOps	RouteOps
+}
+
+func New( config *Config ) *Resolver { if config == nil { config = &Config{} }; return &Resolver{ Config: config } }
+func (r *Resolver) SetRouteOps(routeOps RouteOps) { r.routeOps = routeOps }
+func (r *Resolver) SetMark(mark int) { r.mark = mark }
+
+// loadServers reads the DNSCrypt servers of the resolver list and appends the configured ones. Servers already known keep their certificates
+func ( r *Resolver ) loadServers() ( servers []*server, err error ) {
+	stamps := []string(nil)
+	if len( r.Config.Filename ) > 0 {
+		switch file, errFile := os.Open( r.Config.Filename ); errFile {
+			case nil:	stamps = ParseDnsStamps( file )
+						log.Println( "Init: Parsed", len( stamps ), "usable DNSCrypt servers from", r.Config.Filename )
+						_ = file.Close()
+			default:	if !errors.Is( errFile, os.ErrNotExist ) { log.Println( "Init: [ERR] Read", r.Config.Filename, "failed:", errFile ) }
+		}
+	}
+	known := map[string]*server{}
+	for _, s := range r.current() { known[s.stamp.String()] = s }
+	for _, stampStr := range append( stamps, r.Config.Servers... ) {
+		stamp, stampErr := dnsstamps.NewServerStampFromString( stampStr )
+		if stampErr != nil || stamp.Proto != dnsstamps.StampProtoTypeDNSCrypt { log.Println( "Init: [ERR] Bad DNSCrypt stamp", stampStr ); return nil, errors.New( "bad DNSCrypt stamp" ) }
+		if s, ok := known[stamp.String()]; ok { servers = append( servers, s ); continue }
+		servers = append( servers, &server{ stamp: stamp } )
+	}
+	return
+}
+
+// current returns the current server list, Reload replaces the list rather than modifying it
+func ( r *Resolver ) current() ( servers []*server ) { r.Lock(); servers = r.servers; r.Unlock(); return }
+
+// Reload replaces the server list with the one of the resolver list, e.g. after an update of the list
+func ( r *Resolver ) Reload() ( err error ) {
+	servers, err := r.loadServers()
+	if err != nil { return }
+	r.Lock(); r.servers = servers; r.Unlock()
+	log.Println( "dUpd: Reloaded", len( servers ), "DNSCrypt resolvers" )
+	return
+}
+
+func ( r *Resolver ) Init() ( err error ) {
+	if r.servers, err = r.loadServers(); err != nil { return }
+	r.dialer = &net.Dialer{																		// Use a custom dialer to set the socket mark on sockets when those are configured
+		Control: func( network, address string, rawConn syscall.RawConn ) ( err error ) {
+			if r.mark == 0 { return }
+			_ = rawConn.Control( func( fd uintptr ) {
+				if err = syscall.SetsockoptInt( int(fd), unix.SOL_SOCKET, unix.SO_MARK, r.mark ); err != nil { log.Println( "Dial: [ERR] Set mark failed:", err ) }
+			})
+			return
+		},
+	}
+	log.Println( "Init: Using total of", len( r.servers ), "DNSCrypt resolvers" )
+	return
+}
+
+// ParseDnsStamps picks the DNSCrypt stamps with reachable IP addresses
+func ParseDnsStamps( reader io.Reader ) ( stamps []string ) {
+	for scanner := bufio.NewScanner( reader ); scanner.Scan(); {
+		line := strings.TrimSpace( scanner.Text() )
+		if !strings.HasPrefix( line, "sdns://" ) { continue }
+		stamp, err := dnsstamps.NewServerStampFromString( line )
+		if err != nil || stamp.Proto != dnsstamps.StampProtoTypeDNSCrypt || len( stamp.ServerPk ) == 0 { continue }
+		host, _, err := net.SplitHostPort( stamp.ServerAddrStr )
+		if err != nil { continue }
+		ip := net.ParseIP( strings.Trim( host, "[]" ) )
+		if ip == nil { continue }
+		if route, err := netlink.RouteGet( ip ); err != nil || len( route ) == 0 { continue }
+		stamps = append( stamps, line )
+	}
+	return
+}
+
+// newQuery creates a DNS query with a random ID
+func newQuery( name string, queryType dnsmessage.Type ) ( query []byte, id uint16, err error ) {
+	qname, err := dnsmessage.NewName( name )
+	if err != nil { return }
+	id = uint16( mathRand.Uint32() )
+	message := dnsmessage.Message{
+		Header:		dnsmessage.Header{ ID: id, RecursionDesired: true },
+		Questions:	[]dnsmessage.Question{ { Name: qname, Type: queryType, Class: dnsmessage.ClassINET } },
+	}
+	query, err = message.Pack()
+	return
+}
+
+// transport sends a message to addr and reads the response, TCP messages are length prefixed
+func ( r *Resolver ) transport( ctx context.Context, network, addr string, message []byte ) ( response []byte, err error ) {
+	conn, err := r.dialer.DialContext( ctx, network, addr )
+	if err != nil { return }
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok { _ = conn.SetDeadline( deadline ) }
+	if network == "tcp" {
+		if _, err = conn.Write( append( binary.BigEndian.AppendUint16( nil, uint16( len( message ) ) ), message... ) ); err != nil { return }
+		length := make( []byte, 2 )
+		if _, err = io.ReadFull( conn, length ); err != nil { return }
+		response = make( []byte, binary.BigEndian.Uint16( length ) )
+		_, err = io.ReadFull( conn, response )
+		return
+	}
+	if _, err = conn.Write( message ); err != nil { return }
+	buf := make( []byte, 65535 )
+	n, err := conn.Read( buf )
+	if err != nil { return }
+	return buf[:n], nil
+}
+
+// exchange encrypts a query, sends it to a DNSCrypt server over UDP, or over TCP when the response was truncated, and decrypts the response
+func ( r *Resolver ) exchange( ctx context.Context, s *server, query []byte ) ( response []byte, err error ) {
+	r.Lock(); cert := s.cert; r.Unlock()
+	if !cert.valid() {
+		if cert, err = r.fetchCertificate( ctx, s ); err != nil { return }
+		r.Lock(); s.cert = cert; r.Unlock()
+	}
+
+	for _, network := range []string{ "udp", "tcp" } {
+		clientSk, clientPk := [32]byte{}, []byte(nil)														// Ephemeral key pair and nonce for every packet, a TCP retry must not reuse the UDP ones
+		if _, err = rand.Read( clientSk[:] ); err != nil { return }
+		if clientPk, err = curve25519.X25519( clientSk[:], curve25519.Basepoint ); err != nil { return }
+		key, keyErr := sharedKey( cert.esVersion, &clientSk, &cert.resolverPk )
+		if keyErr != nil { return nil, keyErr }
+		nonce := [24]byte{}																					// Client nonce followed by zeros
+		if _, err = rand.Read( nonce[:12] ); err != nil { return }
+
+		minLength := 256																					// Queries sent over UDP must not be shorter than 256 bytes
+		if network == "tcp" { minLength = 0 }
+		packet := append( append( append( []byte( nil ), cert.clientMagic[:]... ), clientPk... ), nonce[:12]... )
+		packet = append( packet, seal( cert.esVersion, &key, &nonce, pad( query, minLength ) )... )
+		encrypted, transportErr := r.transport( ctx, network, s.stamp.ServerAddrStr, packet )
+		if transportErr != nil { return nil, transportErr }
+
+		if len( encrypted ) < len( resolverMagic ) + 24 || !bytes.Equal( encrypted[:len( resolverMagic )], resolverMagic ) { return nil, errors.New( "bad resolver magic" ) }
+		responseNonce := [24]byte{}
+		copy( responseNonce[:], encrypted[len( resolverMagic ):] )
+		if !bytes.Equal( responseNonce[:12], nonce[:12] ) { return nil, errors.New( "response nonce mismatch" ) }
+		padded, openErr := open( cert.esVersion, &key, &responseNonce, encrypted[len( resolverMagic ) + 24:] )
+		if openErr != nil { return nil, openErr }
+		if response, err = unpad( padded ); err != nil { return }
+		if len( response ) > 2 && response[2] & 0x02 != 0 && network == "udp" { continue }					// Truncated, retry over TCP
+		return
+	}
+	return
+}
+
+// query resolves name of type queryType using a DNSCrypt server
+func ( r *Resolver ) query( ctx context.Context, s *server, name string, queryType dnsmessage.Type ) ( ips []net.IP, err error ) {
+	if r.routeOps != nil {																					// Add a throw route when required
+		host, _, _ := net.SplitHostPort( s.stamp.ServerAddrStr )
+		if ip := net.ParseIP( strings.Trim( host, "[]" ) ); ip != nil {
+			mask := net.CIDRMask( 128, 128 )
+			if ip4 := ip.To4(); ip4 != nil { ip, mask = ip4, net.CIDRMask( 32, 32 ) }
+			if err = r.routeOps.ThrowRouteAdd( "DNSCrypt server " + s.stamp.ProviderName, &net.IPNet{ IP: ip, Mask: mask } ); err != nil { return }
+			defer r.routeOps.ThrowRouteDel( "DNSCrypt server " + s.stamp.ProviderName, &net.IPNet{ IP: ip, Mask: mask } )
+		}
+	}
+	query, id, err := newQuery( name, queryType )
+	if err != nil { return }
+	queryCtx, cancel := context.WithTimeout( ctx, 3 * time.Second )
+	defer cancel()
+	response, err := r.exchange( queryCtx, s, query )
+	if err != nil { return }
+
+	msg := dnsmessage.Message{}
+	if err = msg.Unpack( response ); err != nil { return }
+	if !msg.Header.Response || msg.Header.ID != id { err = errors.New( "bad response" ); return }
+	if msg.Header.RCode != dnsmessage.RCodeSuccess { err = errors.New( "bad response code " + msg.Header.RCode.String() ); return }
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.( type ) {
+			case *dnsmessage.AResource:		if queryType == dnsmessage.TypeA { ips = append( ips, net.IP( body.A[:] ) ) }
+			case *dnsmessage.AAAAResource:	if queryType == dnsmessage.TypeAAAA { ips = append( ips, net.IP( body.AAAA[:] ) ) }
+		}
+	}
+	return
+}
+
+// ResolveType asks the DNSCrypt servers, in random order, until one answers. hideservers.net answers get verified by another server through the dash-encoded names
+func ( r *Resolver ) ResolveType( ctx context.Context, name string, queryType dnsmessage.Type ) ( ips []net.IP, err error ) {
+	servers := r.current()
+	if len( servers ) == 0 { err = errors.New( "empty DNSCrypt server list" ); return }
+	if !strings.HasSuffix( name, "." ) { name += "." }
+	order, answered := mathRand.Perm( len( servers ) ), -1
+	for i, index := range order {
+		s := servers[index]
+		if ips, err = r.query( ctx, s, name, queryType ); err == nil { answered = i; log.Println( "DCry:", s.stamp.ProviderName, "resolved", queryType, "for", strings.TrimSuffix( name, "." ), "to", ips ); break }
+		log.Println( "DCry: [ERR]", s.stamp.ProviderName, "failed:", err )
+		if ctx.Err() != nil { return }
+	}
+	if answered < 0 || len( ips ) == 0 || !strings.HasSuffix( name, ".hideservers.net." ) { return }
+
+	verifier := servers[order[( answered + 1 ) % len( order )]]											// Another server, unless there's just one
+	verified := []net.IP(nil)
+	for _, ip := range ips {
+		dashName := strings.ReplaceAll( ip.String(), ".", "-" ) + ".hideservers.net."
+		if queryType == dnsmessage.TypeAAAA { dashName = strings.ReplaceAll( ip.String(), ":", "-" ) + "-v6.hideservers.net." }
+		dashIps, dashErr := r.query( ctx, verifier, dashName, queryType )
+		if dashErr != nil { log.Println( "DCry: [ERR]", verifier.stamp.ProviderName, "failed:", dashErr ); continue }
+		for _, dashIp := range dashIps { if dashIp.Equal( ip ) { verified = append( verified, ip ); break } }
+	}
+	if len( verified ) == 0 { log.Println( "DCry: [ERR] Could not verify", ips ); return nil, errors.New( "verification failed" ) }
+	return verified, nil
+}
+
+// Resolve resolves the IPv4 and IPv6 addresses of name
+func ( r *Resolver ) Resolve( ctx context.Context, name string ) ( ips []net.IP, err error ) {
+	for _, queryType := range []dnsmessage.Type{ dnsmessage.TypeA, dnsmessage.TypeAAAA } {
+		typeIps, typeErr := r.ResolveType( ctx, name, queryType )
+		if typeErr != nil { err = typeErr; continue }
+		ips = append( ips, typeIps... )
+	}
+	if len( ips ) > 0 { err = nil }
+	return
+}
+
+// ResolveVerified resolves name like Resolve does, hideservers.net addresses are always verified
+func ( r *Resolver ) ResolveVerified( ctx context.Context, name string ) ( ips []net.IP, verified bool, err error ) {
+	if ips, err = r.Resolve( ctx, name ); err != nil { return }
+	return ips, strings.HasSuffix( strings.TrimSuffix( name, "." ) + ".", ".hideservers.net." ), nil
+}
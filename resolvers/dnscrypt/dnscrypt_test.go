@@ -0,0 +1,274 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jedisct1/go-dnsstamps"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testProvider = "2.dnscrypt-cert.test."
+
+// testCert describes a certificate the stand-in server publishes
+type testCert struct {
+	esVersion		uint16
+	serial			uint32
+	notBefore		time.Time
+	notAfter		time.Time
+	badSignature	bool
+	resolverSk		[32]byte
+	clientMagic		[8]byte
+}
+
+// testPacket records an encrypted query the stand-in server received
+type testPacket struct {
+	network		string
+	clientPk	[32]byte
+	nonce		[12]byte
+	esVersion	uint16
+}
+
+// testServer is a DNSCrypt server stand-in listening on UDP and TCP of the same loopback port
+type testServer struct {
+	sync.Mutex
+	providerSk		ed25519.PrivateKey
+	providerPk		ed25519.PublicKey
+	certs			[]*testCert
+	answer			net.IP
+	truncateUdp		bool																					// Answer UDP queries with truncated responses
+	badNonce		bool																					// Echo a client nonce other than the query's one
+	badMagic		bool																					// Prefix responses with a bad resolver magic
+	packets			[]testPacket
+	udpConn			*net.UDPConn
+	listener		net.Listener
+}
+
+func newTestCert( t *testing.T, esVersion uint16, serial uint32 ) *testCert {
+	t.Helper()
+	cert := &testCert{ esVersion: esVersion, serial: serial, notBefore: time.Now().Add( -time.Hour ), notAfter: time.Now().Add( time.Hour ) }
+	if _, err := rand.Read( cert.resolverSk[:] ); err != nil { t.Fatal( err ) }
+	if _, err := rand.Read( cert.clientMagic[:] ); err != nil { t.Fatal( err ) }
+	return cert
+}
+
+func newTestServer( t *testing.T, certs ...*testCert ) *testServer {
+	t.Helper()
+	s := &testServer{ certs: certs, answer: net.IPv4( 192, 0, 2, 1 ).To4() }
+	var err error
+	if s.providerPk, s.providerSk, err = ed25519.GenerateKey( rand.Reader ); err != nil { t.Fatal( err ) }
+	if s.udpConn, err = net.ListenUDP( "udp", &net.UDPAddr{ IP: net.IPv4( 127, 0, 0, 1 ) } ); err != nil { t.Fatal( err ) }
+	if s.listener, err = net.Listen( "tcp", s.udpConn.LocalAddr().String() ); err != nil { _ = s.udpConn.Close(); t.Skip( "TCP port of the UDP listener is taken:", err ) }
+	t.Cleanup( func() { _ = s.udpConn.Close(); _ = s.listener.Close() } )
+	go s.serveUdp()
+	go s.serveTcp()
+	return s
+}
+
+// bin serializes and signs a certificate
+func ( s *testServer ) bin( cert *testCert ) []byte {
+	resolverPk, _ := curve25519.X25519( cert.resolverSk[:], curve25519.Basepoint )
+	signed := append( append( []byte( nil ), resolverPk... ), cert.clientMagic[:]... )
+	signed = binary.BigEndian.AppendUint32( signed, cert.serial )
+	signed = binary.BigEndian.AppendUint32( signed, uint32( cert.notBefore.Unix() ) )
+	signed = binary.BigEndian.AppendUint32( signed, uint32( cert.notAfter.Unix() ) )
+	signature := ed25519.Sign( s.providerSk, signed )
+	if cert.badSignature { signature[0] ^= 0xff }
+	bin := binary.BigEndian.AppendUint16( append( []byte( nil ), certMagic... ), cert.esVersion )
+	bin = binary.BigEndian.AppendUint16( bin, 0 )
+	return append( append( bin, signature... ), signed... )
+}
+
+// stamp returns the DNS stamp of the stand-in server
+func ( s *testServer ) stamp() string {
+	stamp := dnsstamps.ServerStamp{ Proto: dnsstamps.StampProtoTypeDNSCrypt, ServerAddrStr: s.udpConn.LocalAddr().String(), ServerPk: s.providerPk, ProviderName: testProvider }
+	return stamp.String()
+}
+
+func ( s *testServer ) resolver( t *testing.T ) *Resolver {
+	t.Helper()
+	r := New( &Config{ Servers: []string{ s.stamp() } } )
+	if err := r.Init(); err != nil { t.Fatal( err ) }
+	return r
+}
+
+func ( s *testServer ) serveUdp() {
+	buf := make( []byte, 65535 )
+	for {
+		n, addr, err := s.udpConn.ReadFromUDP( buf )
+		if err != nil { return }
+		if response := s.handle( "udp", append( []byte( nil ), buf[:n]... ) ); response != nil { _, _ = s.udpConn.WriteToUDP( response, addr ) }
+	}
+}
+
+func ( s *testServer ) serveTcp() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil { return }
+		go func() {
+			defer conn.Close()
+			length := make( []byte, 2 )
+			if _, err := io.ReadFull( conn, length ); err != nil { return }
+			packet := make( []byte, binary.BigEndian.Uint16( length ) )
+			if _, err := io.ReadFull( conn, packet ); err != nil { return }
+			if response := s.handle( "tcp", packet ); response != nil { _, _ = conn.Write( append( binary.BigEndian.AppendUint16( nil, uint16( len( response ) ) ), response... ) ) }
+		}()
+	}
+}
+
+// handle answers certificate queries in plain DNS and encrypted queries of the published certificates
+func ( s *testServer ) handle( network string, packet []byte ) []byte {
+	s.Lock(); defer s.Unlock()
+	for _, cert := range s.certs {
+		if len( packet ) < 52 || !bytes.Equal( packet[:8], cert.clientMagic[:] ) { continue }
+		recorded := testPacket{ network: network, esVersion: cert.esVersion }
+		copy( recorded.clientPk[:], packet[8:40] )
+		copy( recorded.nonce[:], packet[40:52] )
+		s.packets = append( s.packets, recorded )
+		key, err := sharedKey( cert.esVersion, &cert.resolverSk, &recorded.clientPk )
+		if err != nil { return nil }
+		nonce := [24]byte{}
+		copy( nonce[:], recorded.nonce[:] )
+		padded, err := open( cert.esVersion, &key, &nonce, packet[52:] )
+		if err != nil { return nil }
+		query, err := unpad( padded )
+		if err != nil { return nil }
+		response := s.answerQuery( query, network == "udp" && s.truncateUdp )
+		if s.badNonce { nonce[0] ^= 0xff }
+		_, _ = rand.Read( nonce[12:] )																		// Server nonce
+		magic := resolverMagic
+		if s.badMagic { magic = []byte( "rnotmagc" ) }
+		return append( append( append( []byte( nil ), magic... ), nonce[:]... ), seal( cert.esVersion, &key, &nonce, pad( response, 0 ) )... )
+	}
+	msg := dnsmessage.Message{}																				// Not encrypted, a certificate query
+	if err := msg.Unpack( packet ); err != nil || len( msg.Questions ) != 1 || msg.Questions[0].Type != dnsmessage.TypeTXT { return nil }
+	msg.Header.Response = true
+	for _, cert := range s.certs {
+		bin := s.bin( cert )
+		msg.Answers = append( msg.Answers, dnsmessage.Resource{
+			Header:	dnsmessage.ResourceHeader{ Name: msg.Questions[0].Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60 },
+			Body:	&dnsmessage.TXTResource{ TXT: []string{ string( bin ) } },
+		})
+	}
+	response, _ := msg.Pack()
+	return response
+}
+
+// answerQuery builds the response to a decrypted query, a truncated one carries no answers
+func ( s *testServer ) answerQuery( query []byte, truncated bool ) []byte {
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack( query ); err != nil || len( msg.Questions ) != 1 { return nil }
+	msg.Header.Response, msg.Header.Truncated = true, truncated
+	if !truncated && msg.Questions[0].Type == dnsmessage.TypeA {
+		a := dnsmessage.AResource{}
+		copy( a.A[:], s.answer )
+		msg.Answers = append( msg.Answers, dnsmessage.Resource{ Header: dnsmessage.ResourceHeader{ Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60 }, Body: &a } )
+	}
+	response, _ := msg.Pack()
+	return response
+}
+
+func ( s *testServer ) received() []testPacket { s.Lock(); defer s.Unlock(); return append( []testPacket( nil ), s.packets... ) }
+
+func testContext( t *testing.T ) context.Context {
+	ctx, cancel := context.WithTimeout( context.Background(), 5 * time.Second )
+	t.Cleanup( cancel )
+	return ctx
+}
+
+func TestParseCertificate( t *testing.T ) {
+	s := &testServer{}
+	var err error
+	if s.providerPk, s.providerSk, err = ed25519.GenerateKey( rand.Reader ); err != nil { t.Fatal( err ) }
+	now := time.Now()
+
+	good := newTestCert( t, esXChaCha20Poly1305, 7 )
+	cert, err := parseCertificate( s.bin( good ), s.providerPk, now )
+	if err != nil { t.Fatal( "valid certificate rejected:", err ) }
+	resolverPk, _ := curve25519.X25519( good.resolverSk[:], curve25519.Basepoint )
+	if cert.esVersion != esXChaCha20Poly1305 || cert.serial != 7 || cert.clientMagic != good.clientMagic || !bytes.Equal( cert.resolverPk[:], resolverPk ) { t.Fatal( "certificate fields not parsed" ) }
+
+	badSignature := newTestCert( t, esXSalsa20Poly1305, 1 )
+	badSignature.badSignature = true
+	expired := newTestCert( t, esXSalsa20Poly1305, 1 )
+	expired.notBefore, expired.notAfter = now.Add( -2 * time.Hour ), now.Add( -time.Hour )
+	future := newTestCert( t, esXSalsa20Poly1305, 1 )
+	future.notBefore, future.notAfter = now.Add( time.Hour ), now.Add( 2 * time.Hour )
+	unsupported := newTestCert( t, 0x0003, 1 )
+	otherProvider, _, _ := ed25519.GenerateKey( rand.Reader )
+	for _, test := range []struct{ name string; bin []byte; providerPk []byte; err string }{
+		{ "bad signature", s.bin( badSignature ), s.providerPk, "signature" },
+		{ "other provider", s.bin( good ), otherProvider, "signature" },
+		{ "expired", s.bin( expired ), s.providerPk, "not valid" },
+		{ "not yet valid", s.bin( future ), s.providerPk, "not valid" },
+		{ "unsupported encryption system", s.bin( unsupported ), s.providerPk, "encryption system" },
+		{ "bad magic", append( []byte( "CSND" ), s.bin( good )[4:]... ), s.providerPk, "magic" },
+		{ "short", s.bin( good )[:100], s.providerPk, "short" },
+	} {
+		if _, err = parseCertificate( test.bin, test.providerPk, now ); err == nil || !strings.Contains( err.Error(), test.err ) { t.Errorf( "%s: got %v, want an error containing %q", test.name, err, test.err ) }
+	}
+}
+
+func TestFetchCertificatePicksSerialAndEncryptionSystem( t *testing.T ) {
+	forged := newTestCert( t, esXSalsa20Poly1305, 9 )															// The highest serial, but not signed by the provider
+	forged.badSignature = true
+	expired := newTestCert( t, esXSalsa20Poly1305, 8 )
+	expired.notBefore, expired.notAfter = time.Now().Add( -2 * time.Hour ), time.Now().Add( -time.Hour )
+	older := newTestCert( t, esXChaCha20Poly1305, 1 )
+	salsa := newTestCert( t, esXSalsa20Poly1305, 2 )
+	chacha := newTestCert( t, esXChaCha20Poly1305, 2 )
+	s := newTestServer( t, forged, expired, older, salsa, chacha )
+	r := s.resolver( t )
+
+	cert, err := r.fetchCertificate( testContext( t ), r.servers[0] )
+	if err != nil { t.Fatal( err ) }
+	if cert.serial != 2 || cert.esVersion != esXChaCha20Poly1305 || cert.clientMagic != chacha.clientMagic { t.Fatalf( "picked serial %d, encryption system %d", cert.serial, cert.esVersion ) }
+
+	s.Lock(); s.certs = []*testCert{ forged, expired }; s.Unlock()
+	if _, err = r.fetchCertificate( testContext( t ), r.servers[0] ); err == nil { t.Fatal( "invalid certificates accepted" ) }
+}
+
+func TestEncryptionSystems( t *testing.T ) {
+	for _, esVersion := range []uint16{ esXSalsa20Poly1305, esXChaCha20Poly1305 } {
+		s := newTestServer( t, newTestCert( t, esVersion, 1 ) )
+		ips, err := s.resolver( t ).ResolveType( testContext( t ), "example.com", dnsmessage.TypeA )
+		if err != nil { t.Fatalf( "encryption system %d: %v", esVersion, err ) }
+		if len( ips ) != 1 || !ips[0].Equal( s.answer ) { t.Fatalf( "encryption system %d: got %v", esVersion, ips ) }
+		if packets := s.received(); len( packets ) != 1 || packets[0].network != "udp" || packets[0].esVersion != esVersion { t.Fatalf( "encryption system %d: packets %+v", esVersion, packets ) }
+	}
+}
+
+func TestTruncatedResponseFallsBackToTcp( t *testing.T ) {
+	s := newTestServer( t, newTestCert( t, esXChaCha20Poly1305, 1 ) )
+	s.Lock(); s.truncateUdp = true; s.Unlock()
+	ips, err := s.resolver( t ).ResolveType( testContext( t ), "example.com", dnsmessage.TypeA )
+	if err != nil { t.Fatal( err ) }
+	if len( ips ) != 1 || !ips[0].Equal( s.answer ) { t.Fatalf( "got %v", ips ) }
+	packets := s.received()
+	if len( packets ) != 2 || packets[0].network != "udp" || packets[1].network != "tcp" { t.Fatalf( "packets %+v", packets ) }
+	if packets[0].nonce == packets[1].nonce { t.Fatal( "TCP retry reused the UDP nonce" ) }
+	if packets[0].clientPk == packets[1].clientPk { t.Fatal( "TCP retry reused the UDP key pair" ) }
+}
+
+func TestResponseMismatchRejected( t *testing.T ) {
+	for _, test := range []struct{ name string; set func( s *testServer ); err string }{
+		{ "nonce", func( s *testServer ) { s.badNonce = true }, "nonce mismatch" },
+		{ "magic", func( s *testServer ) { s.badMagic = true }, "resolver magic" },
+	} {
+		s := newTestServer( t, newTestCert( t, esXSalsa20Poly1305, 1 ) )
+		s.Lock(); test.set( s ); s.Unlock()
+		r := s.resolver( t )
+		_, err := r.query( testContext( t ), r.servers[0], "example.com.", dnsmessage.TypeA )
+		if err == nil || !strings.Contains( err.Error(), test.err ) { t.Errorf( "%s: got %v, want an error containing %q", test.name, err, test.err ) }
+	}
+}
@@ -0,0 +1,84 @@
+package doh
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type cacheKey struct {
+	name		string
+	queryType	dnsmessage.Type
+}
+
+type cacheEntry struct {
+	Name		string				`json:"name"`
+	Type		dnsmessage.Type		`json:"type"`
+	IPs			[]net.IP			`json:"ips,omitempty"`																		// Empty for negative entries ( NXDOMAIN or no data )
+	Expires		time.Time			`json:"expires"`
+}
+
+// cache keeps resolved names for as long as their TTLs allow, optionally persisted to disk for fast cold starts
+type cache struct {
+	sync.Mutex
+	minTtl		time.Duration
+	maxTtl		time.Duration
+	filename	string
+	entries		map[cacheKey]*cacheEntry
+}
+
+func newCache( minTtl, maxTtl time.Duration, filename string ) *cache {
+	return &cache{ minTtl: minTtl, maxTtl: maxTtl, filename: filename, entries: map[cacheKey]*cacheEntry{} }
+}
+
+// get returns a cached answer, found is false when there's no fresh entry. No ips with found set means a negative answer has been cached
+func ( c *cache ) get( name string, queryType dnsmessage.Type ) ( ips []net.IP, found bool ) {
+	if c == nil { return }
+	c.Lock(); defer c.Unlock()
+	entry, found := c.entries[cacheKey{ name, queryType }]
+	if !found { return }
+	if time.Now().After( entry.Expires ) { delete( c.entries, cacheKey{ name, queryType } ); return nil, false }
+	return entry.IPs, true
+}
+
+// put stores an answer, the TTL gets clamped to the configured limits
+func ( c *cache ) put( name string, queryType dnsmessage.Type, ips []net.IP, ttl time.Duration ) {
+	if c == nil { return }
+	ttl = min( max( ttl, c.minTtl ), c.maxTtl )
+	c.Lock(); defer c.Unlock()
+	now := time.Now()
+	for key, entry := range c.entries { if now.After( entry.Expires ) { delete( c.entries, key ) } }
+	c.entries[cacheKey{ name, queryType }] = &cacheEntry{ Name: name, Type: queryType, IPs: ips, Expires: now.Add( ttl ) }
+	c.save()
+}
+
+// load reads the persisted entries, expired ones get dropped
+func ( c *cache ) load() {
+	if c == nil || len( c.filename ) == 0 { return }
+	content, err := os.ReadFile( c.filename )
+	if err != nil { if !errors.Is( err, os.ErrNotExist ) { log.Println( "Init: [ERR] Read DoH cache", c.filename, "failed:", err ) }; return }
+	entries := []*cacheEntry(nil)
+	if err = json.Unmarshal( content, &entries ); err != nil { log.Println( "Init: [ERR] Parse DoH cache", c.filename, "failed:", err ); return }
+	c.Lock(); defer c.Unlock()
+	now := time.Now()
+	for _, entry := range entries {
+		if now.Before( entry.Expires ) { c.entries[cacheKey{ entry.Name, entry.Type }] = entry }
+	}
+	log.Println( "Init: Loaded", len( c.entries ), "DoH cache entries from", c.filename )
+}
+
+// save persists the entries, must be called with the cache locked
+func ( c *cache ) save() {
+	if len( c.filename ) == 0 { return }
+	entries := make( []*cacheEntry, 0, len( c.entries ) )
+	for _, entry := range c.entries { entries = append( entries, entry ) }
+	content, err := json.Marshal( entries )
+	if err != nil { return }
+	if err = os.WriteFile( c.filename, content, 0600 ); err != nil { log.Println( "DoHc: [ERR] Write DoH cache", c.filename, "failed:", err ) }
+}
@@ -9,7 +9,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	
@@ -18,6 +21,14 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+const (
+	maxCnameChain = 8																																// Longest CNAME chain followed within an answer
+	ednsPaddingOption = 12																															// EDNS0 padding option code ( RFC 7830 )
+)
+
+// DNSCryptMinisignKey is the public key the DNSCrypt project signs its resolver lists with
+const DNSCryptMinisignKey = "RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3"
+
 type RouteOps interface {
 	ThrowRouteAdd( logPrefix string, dst *net.IPNet ) ( err error )
 	ThrowRouteDel( logPrefix string, dst *net.IPNet ) ( err error )
@@ -26,20 +37,32 @@ type RouteOps interface {
 type Config struct {
 	Servers		[]string	`json:"servers,omitempty"`		// DNS stamps
 	UpdateURLs	[]string	`json:"updateURLs,omitempty"`	// Update URLs
+	UpdateInterval	time.Duration	`json:"updateInterval,omitempty"`	// Period of automatic updates in service mode, 0 disables those
 	Filename	string		`json:"filename,omitempty"`		// Storage file
+	MinisignKey	string		`json:"minisignKey,omitempty"`	// Minisign public key the lists at UpdateURLs are signed with, empty disables the verification
+	CacheMinTtl		time.Duration	`json:"cacheMinTtl,omitempty"`		// Lower TTL limit for cached answers
+	CacheMaxTtl		time.Duration	`json:"cacheMaxTtl,omitempty"`		// Upper TTL limit for cached answers, 0 disables caching
+	CacheFilename	string			`json:"cacheFilename,omitempty"`	// Cache persistence file, the cache is kept in memory only when empty
+	UdpSize			uint16			`json:"udpSize,omitempty"`			// EDNS0 UDP payload size advertised in queries, 0 disables EDNS0 ( and padding )
+	PaddingBlockSize	int			`json:"paddingBlockSize,omitempty"`	// Queries get padded to a multiple of this size, 0 disables padding
+	NoVerify		[]string		`json:"noVerify,omitempty"`			// Name patterns ( e.g. "*.hideservers.net" ) for which the verification phase is skipped
 }
 
 type Resolver struct {
 	*Config
 	dohServers	[]string
+	serversLock	sync.Mutex	// Guards dohServers, which Reload replaces
 	dialer		*net.Dialer
 	mark		int
 	routeOps	RouteOps	// Routing subsystem interface
+	cache		*cache		// Resolved names, nil when caching is disabled
+	stats		*stats		// Per-server health statistics
 }
 
 type DoHResponse struct {
 	index		int
-	ip			net.IP
+	ips			[]net.IP
+	ttl			time.Duration
 	err			error
 }
 
@@ -47,19 +70,33 @@ func New( config *Config ) *Resolver { if config == nil { config = &Config{} };
 func (d *Resolver) SetRouteOps( routeOps RouteOps ) { d.routeOps = routeOps }
 func (d *Resolver) SetMark(mark int) { d.mark = mark }
 
-func ( d *Resolver ) Init() {
+// loadServers reads the DoH servers of the resolvers file and appends the configured ones
+func ( d *Resolver ) loadServers() ( dohServers []string ) {
 	if len( d.Config.Filename ) > 0 {
 		switch file, errFile := os.Open( d.Config.Filename ); errFile {
-			case nil:	d.dohServers = d.ParseDnsStamps(file)
-						log.Println( "Init: Parsed", len(d.dohServers), "usable DoH servers from", d.Config.Filename )
+			case nil:	dohServers = d.ParseDnsStamps(file)
+						log.Println( "Init: Parsed", len(dohServers), "usable DoH servers from", d.Config.Filename )
 						_ = file.Close()
 			default:	if errors.Is(errFile, os.ErrNotExist) { log.Println( "Init: [WARN] DoH resolvers file", d.Config.Filename, "does not exist" ); break }
 						log.Println( "Init: [ERR] Read", d.Config.Filename, "failed:", errFile )
 						_ = file.Close()
 		}
 	}
-	d.dohServers = append( d.dohServers, d.Config.Servers... )																						// Add configured DoH servers
-	d.RandomizeOrder()
+	return append( dohServers, d.Config.Servers... )																								// Add configured DoH servers
+}
+
+// servers returns the current DoH server list, Reload replaces the list rather than modifying it
+func ( d *Resolver ) servers() ( dohServers []string ) { d.serversLock.Lock(); dohServers = d.dohServers; d.serversLock.Unlock(); return }
+
+func ( d *Resolver ) Init() {
+	d.dohServers = d.loadServers()
+	for _, pattern := range d.Config.NoVerify {
+		if _, err := path.Match( pattern, "" ); err != nil { log.Println( "Init: [ERR] Bad DoH noVerify pattern", pattern ) } else { log.Println( "Init: [WARN] DoH answers for", pattern, "won't be verified" ) }
+	}
+	d.stats = newStats( d.siblingFilename( ".stats.json" ) )																											// Servers get ordered by their health statistics
+	d.stats.load()
+	d.stats.prune( d.dohServers )
+	if d.Config.CacheMaxTtl > 0 { d.cache = newCache( d.Config.CacheMinTtl, d.Config.CacheMaxTtl, d.Config.CacheFilename ); d.cache.load() }
 	d.dialer = &net.Dialer{																															// Use a custom dialer to set the socket mark on sockets when those are configured
 		Control: func( network, address string, rawConn syscall.RawConn ) ( err error ) {
 			if d.mark == 0 { return }
@@ -73,44 +110,110 @@ func ( d *Resolver ) Init() {
 	return
 }
 
-// createDnsMessage creates a DNS message
+// Reload replaces the DoH server list with the one of the resolvers file, e.g. after an update of the file
+func ( d *Resolver ) Reload() ( err error ) {
+	dohServers := d.loadServers()
+	d.serversLock.Lock(); d.dohServers = dohServers; d.serversLock.Unlock()
+	d.stats.prune( dohServers )
+	log.Println( "dUpd: Reloaded", len( dohServers ), "DoH resolvers" )
+	return
+}
+
+// createDnsMessage creates a DNS message. When EDNS0 is enabled the message carries an OPT record, padded to a multiple of the padding block size ( RFC 7830, RFC 8467 )
 func ( d *Resolver ) createDnsMessage( name string, messageType dnsmessage.Type ) ( buf []byte, err error ) {
 	qname, err := dnsmessage.NewName(name)
 	if err != nil { return }
-	/* optRR := dnsmessage.Resource{
-		Header: dnsmessage.ResourceHeader{ Type: dnsmessage.TypeOPT, Class: 1280, Name: dnsmessage.MustNewName(".") },
-		Body:   &dnsmessage.OPTResource{},
-	} */
 	message := dnsmessage.Message{
 		Header:			dnsmessage.Header{ RecursionDesired: true },
 		Questions:		[]dnsmessage.Question{ { Name: qname, Type: messageType, Class: dnsmessage.ClassINET } },
-		// Additionals:	[]dnsmessage.Resource{optRR},
 	}
+	if d.Config.UdpSize == 0 { return message.Pack() }
+	
+	optRR := dnsmessage.Resource{ Body: &dnsmessage.OPTResource{} }
+	if err = optRR.Header.SetEDNS0( int( d.Config.UdpSize ), dnsmessage.RCodeSuccess, false ); err != nil { return }
+	message.Additionals = []dnsmessage.Resource{ optRR }
+	if d.Config.PaddingBlockSize <= 0 { return message.Pack() }
+	
+	optBody := optRR.Body.( *dnsmessage.OPTResource )
+	optBody.Options = []dnsmessage.Option{ { Code: ednsPaddingOption } }																			// An empty padding option first, to learn the length of the message
+	if buf, err = message.Pack(); err != nil { return }
+	optBody.Options[0].Data = make( []byte, ( d.Config.PaddingBlockSize - len( buf ) % d.Config.PaddingBlockSize ) % d.Config.PaddingBlockSize )
 	return message.Pack()
 }
 
-// parseMessageForName parses a DNS message, checks validity, looks for answers regarding name
-func ( d *Resolver ) parseMessageForNameAndType( message []byte, name string, questionType dnsmessage.Type ) ( ip net.IP , err error ) {
+// skipVerification checks whether the verification of name's answers has been disabled by a NoVerify pattern
+func ( d *Resolver ) skipVerification( name string ) bool {
+	for _, pattern := range d.Config.NoVerify {
+		if matched, _ := path.Match( pattern, strings.TrimSuffix( name, "." ) ); matched { return true }
+	}
+	return false
+}
+
+// parseMessageForName parses a DNS message, checks validity, looks for answers regarding name. CNAME chains within the answers section get followed, all the addresses of the canonical name are returned along with the lowest TTL of the chain or, for negative answers, the SOA TTL
+func ( d *Resolver ) parseMessageForNameAndType( message []byte, name string, questionType dnsmessage.Type ) ( ips []net.IP, ttl time.Duration, err error ) {
 	msg := dnsmessage.Message{}
 	if err = msg.Unpack( message ); err != nil { return }
 	if !msg.Header.Response { err = errors.New( "not a response message" ); return }
 	if msg.Header.OpCode != 0 { err = errors.New( "not a query response" ); return }
-	if msg.Header.RCode != dnsmessage.RCodeSuccess { err = errors.New( "bad response code " + msg.Header.RCode.String() ); return }
+	if msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError { err = errors.New( "bad response code " + msg.Header.RCode.String() ); return }
 	
 	valid := false																																	// Check the questions section, it must contain "name"
 	for _, question := range msg.Questions { if question.Name.String() == name { valid = true; break } }
 	if !valid { err = errors.New( "questions section does not contain" + name ); return }
 	
+	cnames := map[string]string{}																													// CNAME records by their owner names, DNS names are case-insensitive
 	for _, answer := range msg.Answers {
-		if answer.Header.Name.String() != name { err = errors.New( "answer for an invalid name" ); return }
 		if answer.Header.Class != dnsmessage.ClassINET { err = errors.New( "invalid answer class" ); return }
-		if answer.Header.Type != questionType { err = errors.New( "query and answer type mismatch" ); return }
-		if answer.Header.Type == dnsmessage.TypeA { if aResource, ok := answer.Body.(*dnsmessage.AResource); ok { ip = aResource.A[:] } }
-		if answer.Header.Type == dnsmessage.TypeAAAA { if aaaaResource, ok := answer.Body.(*dnsmessage.AAAAResource); ok { ip = aaaaResource.AAAA[:] } }
+		cname, isCname := answer.Body.( *dnsmessage.CNAMEResource )
+		if !isCname { continue }
+		owner := strings.ToLower( answer.Header.Name.String() )
+		if _, exists := cnames[owner]; exists { err = errors.New( "multiple CNAME records for " + owner ); return }
+		cnames[owner] = strings.ToLower( cname.CNAME.String() )
+	}
+	target := strings.ToLower( name )																												// Follow the CNAME chain from name to the canonical name
+	chain := map[string]bool{ target: true }
+	for next, found := cnames[target]; found; next, found = cnames[target] {
+		if chain[next] { err = errors.New( "CNAME loop at " + next ); return }
+		if len( chain ) > maxCnameChain { err = errors.New( "CNAME chain is too long" ); return }
+		chain[next], target = true, next
+	}
+	
+	haveTtl := false
+	for _, answer := range msg.Answers {
+		owner := strings.ToLower( answer.Header.Name.String() )
+		if !chain[owner] { err = errors.New( "answer for an invalid name" ); return }																// Every answer must be a step of the chain
+		switch answer.Header.Type {
+			case dnsmessage.TypeCNAME:
+			case questionType:
+				if owner != target { err = errors.New( "answer for a name which has a CNAME" ); return }
+				if aResource, ok := answer.Body.(*dnsmessage.AResource); ok { ips = append( ips, aResource.A[:] ) }
+				if aaaaResource, ok := answer.Body.(*dnsmessage.AAAAResource); ok { ips = append( ips, aaaaResource.AAAA[:] ) }
+			default: err = errors.New( "query and answer type mismatch" ); return
+		}
+		if answerTtl := time.Duration( answer.Header.TTL ) * time.Second; !haveTtl || answerTtl < ttl { ttl, haveTtl = answerTtl, true }
+	}
+	if len( ips ) > 0 && msg.Header.RCode == dnsmessage.RCodeSuccess { return }
+	
+	ips, ttl, err = nil, 0, ErrNegativeAnswer																												// NXDOMAIN or no data, negative answers are cached according to the SOA record ( RFC 2308 )
+	for _, authority := range msg.Authorities {
+		if soa, isSoa := authority.Body.( *dnsmessage.SOAResource ); isSoa { ttl = time.Duration( min( authority.Header.TTL, soa.MinTTL ) ) * time.Second }
 	}
 	return
 }
 
+// throwRoute adds a throw route towards an IP endpoint when route operations are set, del removes it
+func ( d *Resolver ) throwRoute( logPrefix string, endpoint string ) ( del func(), err error ) {
+	del = func() {}
+	if len( endpoint ) == 0 || d.routeOps == nil { return }
+	host, _, _ := net.SplitHostPort(endpoint)
+	ip := net.ParseIP(host)
+	if ip == nil { return }
+	mask := net.CIDRMask(128,128)
+	if ip4 := ip.To4(); ip4 != nil { ip, mask = ip4, net.CIDRMask(32,32) }
+	if err = d.routeOps.ThrowRouteAdd( logPrefix, &net.IPNet{IP: ip, Mask: mask }); err != nil { return }
+	return func() { _ = d.routeOps.ThrowRouteDel( logPrefix, &net.IPNet{IP: ip, Mask: mask } ) }, nil
+}
+
 // postDnsMessage issues a HTTP POST request with appropriate headers. When endpoint contains an address a direct connection, without DNS resolution, will be made
 func ( d *Resolver ) postDnsMessage( ctx context.Context, url string, endpoint string, message []byte ) ( responseBody []byte, err error ) {
 	request, err := http.NewRequestWithContext( ctx, "POST", url, bytes.NewReader( message ) )
@@ -128,15 +231,9 @@ func ( d *Resolver ) postDnsMessage( ctx context.Context, url string, endpoint s
 		},
 	}
 	
-	if len( endpoint ) > 0 && d.routeOps != nil {																									// Add a throw route when required
-		host, _, _ := net.SplitHostPort(endpoint)
-		if ip := net.ParseIP(host); ip != nil {
-			mask := net.CIDRMask(128,128)
-			if ip4 := ip.To4(); ip4 != nil { ip, mask = ip4, net.CIDRMask(32,32) }
-			if err = d.routeOps.ThrowRouteAdd( url, &net.IPNet{IP: ip, Mask: mask }); err != nil { return nil, err }
-			defer d.routeOps.ThrowRouteDel( url, &net.IPNet{IP: ip, Mask: mask } )
-		}
-	}
+	del, err := d.throwRoute( url, endpoint )																										// Add a throw route when required
+	if err != nil { return }
+	defer del()
 	
 	response, err := httpClient.Do( request )
 	if err != nil { return }
@@ -145,51 +242,59 @@ func ( d *Resolver ) postDnsMessage( ctx context.Context, url string, endpoint s
 	return io.ReadAll(response.Body)
 }
 
-// ParallelDoH issues DNS-over-HTTPs requests in parallel. The number of parallel requests is determined by the dohServers slice length
+// ParallelDoH issues DNS-over-HTTPs ( or DNS-over-TLS ) requests in parallel. The number of parallel requests is determined by the dohServers slice length
 func ( d *Resolver ) ParallelDoH( ctx context.Context, dohServers []string, name string, questionType dnsmessage.Type ) ( responses chan DoHResponse, err error ){
 	requestBuf, err := d.createDnsMessage( name, questionType )																						// Create a DNS message to resolve "name"
 	if err != nil { log.Println( "PDoH: [ERR] Create DNS message failed:", err ); return }
 	
 	responses = make( chan DoHResponse, len(dohServers) )
-	var stamp dnsstamps.ServerStamp
-	for i := 0; i < len(dohServers); i++ {																											// Send POST requests
+	for i := 0; i < len(dohServers); i++ {																											// Send the queries
 		go func() {
 			var responseBuf []byte
+			var stamp dnsstamps.ServerStamp
 			response := DoHResponse{index: i}
 			defer func() { responses <- response } ()																								// Always send on a channel signaling completion, even if no IP got resolved
 			
-			dohServer, endpoint := dohServers[i], ""																								// DoH servers may be URLs or DNS stamps
+			dohServer, endpoint := dohServers[i], ""																								// DoH servers may be URLs or DNS stamps, DNS stamps may be DoH or DoT stamps
 			if strings.HasPrefix( dohServer, "sdns://" ) {
-				stamp, response.err = dnsstamps.NewServerStampFromString(dohServer)
+				stamp, response.err = parseStamp(dohServer)
 				if response.err != nil { log.Println( "PDoH: [ERR] Bad DNS stamp in", dohServer ); return }
-				if stamp.Proto != dnsstamps.StampProtoTypeDoH { log.Println( "PDoH: [ERR] Not a DoH server in", dohServer ); response.err = errors.New("bad server"); return }
-				dohServer = "https://" + stamp.ProviderName + stamp.Path
+				switch stamp.Proto {
+					case dnsstamps.StampProtoTypeDoH:	dohServer = "https://" + stamp.ProviderName + stamp.Path
+					case dnsstamps.StampProtoTypeTLS:	dohServer = "tls://" + stamp.ProviderName
+					default:							log.Println( "PDoH: [ERR] Not a DoH or DoT server in", dohServer ); response.err = errors.New("bad server"); return
+				}
 				endpoint = stamp.ServerAddrStr
 			}
 			
 			log.Println( "PDoH: Asking", dohServer, "for", questionType, "of", strings.TrimSuffix(name, ".") )
 			start := time.Now()
-			responseBuf, response.err = d.postDnsMessage( ctx, dohServer, endpoint, requestBuf )
-			if errors.Is( response.err, context.DeadlineExceeded ) { log.Println( "PDoH: [ERR]", dohServer, "timed out" ); return }
-			if errors.Is( response.err, context.Canceled ) { return }
-			if response.err != nil { log.Println( "PDoH: [ERR]", dohServer, "failed:", response.err ); return }
-			response.ip, response.err = d.parseMessageForNameAndType( responseBuf, name, questionType )
+			if stamp.Proto == dnsstamps.StampProtoTypeTLS { responseBuf, response.err = d.dotExchange( ctx, stamp, requestBuf ) } else { responseBuf, response.err = d.postDnsMessage( ctx, dohServer, endpoint, requestBuf ) }
+			if errors.Is( response.err, context.DeadlineExceeded ) { log.Println( "PDoH: [ERR]", dohServer, "timed out" ); d.stats.failure( dohServers[i], response.err ); return }
+			if errors.Is( response.err, context.Canceled ) { return }																				// Another server answered first, not a failure
+			if response.err != nil { log.Println( "PDoH: [ERR]", dohServer, "failed:", response.err ); d.stats.failure( dohServers[i], response.err ); return }
+			response.ips, response.ttl, response.err = d.parseMessageForNameAndType( responseBuf, name, questionType )
+			if response.err != nil && !errors.Is( response.err, ErrNegativeAnswer ) { d.stats.failure( dohServers[i], response.err ) } else { d.stats.success( dohServers[i], time.Since(start) ) }
+			if errors.Is( response.err, ErrNegativeAnswer ) { log.Println( "PDoH: [ERR]", dohServer, "could not resolve", questionType, "for", strings.TrimSuffix(name, "."), "in", time.Since(start) ); return }
 			if response.err != nil { log.Println( "PDoH: [ERR] Parse DNS message from", dohServer, "failed:", response.err ); return }
-			if response.ip == nil { log.Println( "PDoH: [ERR]", dohServer, "could not resolve", questionType, "for", strings.TrimSuffix(name, "."), "in", time.Since(start) ); return }
-			log.Println( "PDoH:", dohServer, "resolved", strings.TrimSuffix(name, "."), "to", response.ip.String(), "in", time.Since(start) )
+			log.Println( "PDoH:", dohServer, "resolved", strings.TrimSuffix(name, "."), "to", response.ips, "in", time.Since(start) )
 		}()
 	}
 	return
 }
 
-// ResolveType resolves "name" of type "queryType" in two phases. In the first phase a lookup for "name" is done. In the second phase a lookup for the dash encoded IP is done
-// A DoH server that resolved in phase 1 won't be used in phase 2 unless necessary
-func ( d *Resolver ) ResolveType( ctx context.Context, name string, queryType dnsmessage.Type ) ( ip net.IP, err error ) {
+// ResolveType resolves "name" of type "queryType" in two phases. In the first phase a lookup for "name" is done. In the second phase a lookup for each dash encoded IP is done
+// A DoH server that resolved in phase 1 won't be used in phase 2 unless necessary. Addresses which could not be verified get dropped. DoH servers are used in the order of their health statistics
+func ( d *Resolver ) ResolveType( ctx context.Context, name string, queryType dnsmessage.Type ) ( ips []net.IP, err error ) {
 	defer func() { if err != nil { log.Println( "DoHx: [ERR] DoH failed:", err ) } }()
-	if len(d.dohServers) == 0 { err = errors.New( "empty DoH server list" ); return }
+	current := d.servers()
+	if len(current) == 0 { err = errors.New( "empty DoH server list" ); return }
 	if !strings.HasSuffix( name, "." ) { name += "." }
+	if cachedIps, found := d.cache.get( name, queryType ); found { log.Println( "DoHc: Cached", queryType, "for", strings.TrimSuffix(name, "."), "is", cachedIps ); return cachedIps, nil }
 	
-	dohServers, successfulServerIndex := d.dohServers, 0
+	servers := d.stats.order( current )
+	defer d.stats.save()
+	dohServers, successfulServerIndex, ttl, negative := servers, 0, time.Duration(0), false
 	for i, parallelism := 1, 1; len(dohServers) > 0; i++ {
 		parallelism *= i
 		if parallelism > len( dohServers ) { parallelism = len( dohServers ) }																		// Use up to parallelism DoH servers
@@ -200,58 +305,81 @@ func ( d *Resolver ) ResolveType( ctx context.Context, name string, queryType dn
 		if pErr != nil { cancel(); return nil, pErr }
 		
 		var response DoHResponse
-		for count := 0; count < cap(responses); count ++ { if response = <-responses; response.err == nil { break } }								// Wait for a first successful response
+		for count := 0; count < cap(responses); count ++ {																							// Wait for a first successful response
+			if response = <-responses; response.err == nil { break }
+			if errors.Is( response.err, ErrNegativeAnswer ) { negative, ttl = true, response.ttl }
+		}
 		cancel()																																	// Cancel all the other parallel DoH queries
-		if response.err == nil { ip = response.ip; successfulServerIndex += response.index; break }													// There was a successful response
+		if response.err == nil { ips, ttl = response.ips, response.ttl; successfulServerIndex += response.index; break }							// There was a successful response
 		
 		dohServers = dohServers[parallelism:]																										// DoH servers used so far failed, proceed with the next batch
 		successfulServerIndex += parallelism
 	}
 	
-	if ip == nil { log.Println( "DoH1: [ERR] Resolve", queryType, "for", strings.TrimSuffix(name, "."), "failed" ); return }
-	log.Println( "DoH1: Resolved", queryType, "for", strings.TrimSuffix(name, "."), "to", ip )														// IP resolved, time to verify it
+	if len( ips ) == 0 {
+		log.Println( "DoH1: [ERR] Resolve", queryType, "for", strings.TrimSuffix(name, "."), "failed" )
+		if negative { d.cache.put( name, queryType, nil, ttl ) }																					// Remember that the name does not exist or has no such records
+		return
+	}
+	log.Println( "DoH1: Resolved", queryType, "for", strings.TrimSuffix(name, "."), "to", ips )														// IPs resolved, time to verify them
 	
-	dohServers = d.dohServers
+	dohServers = servers
 	if len(dohServers) > 1 {																														// When there's just one DoH server in the list we have to reuse it
 		dohServers[successfulServerIndex], dohServers[len(dohServers)-1] = dohServers[len(dohServers)-1], dohServers[successfulServerIndex]
 		dohServers = dohServers[:len(dohServers)-1]
 	}
 	
-	if !strings.HasSuffix( name, ".hideservers.net." ) { return }																					// Skip verifications, except for hideservers.net
+	if !strings.HasSuffix( name, ".hideservers.net." ) || d.skipVerification( name ) { d.cache.put( name, queryType, ips, ttl ); return }		// Skip verifications, except for hideservers.net
+	verifiedIps := []net.IP(nil)
+	for _, ip := range ips {
+		verified, vErr := d.verify( ctx, dohServers, ip, queryType )
+		if vErr != nil { return nil, vErr }
+		if verified { verifiedIps = append( verifiedIps, ip ) }
+	}
+	if len( verifiedIps ) == 0 { return }
+	d.cache.put( name, queryType, verifiedIps, ttl )																								// Cache verified answers only
+	return verifiedIps, nil
+}
+
+// verify looks up the dash encoded ip, the ip is verified when a DoH server resolves the dash encoded name to the same ip
+func ( d *Resolver ) verify( ctx context.Context, dohServers []string, ip net.IP, queryType dnsmessage.Type ) ( verified bool, err error ) {
+	name := ""
 	switch queryType {																																// Construct the name as a dash-encoded IP address
 		case dnsmessage.TypeA:		name = strings.ReplaceAll( ip.String(), ".", "-" ) + ".hideservers.net."
 		case dnsmessage.TypeAAAA:	name = strings.ReplaceAll( ip.String(), ":", "-" ) + "-v6.hideservers.net."
 	}
-	verified := false
-	successfulServerIndex = 0;
 	for i, parallelism := 1, 1; len(dohServers) > 0; i++ {
 		parallelism *= i
 		if parallelism > len( dohServers ) { parallelism = len( dohServers ) }																		// Use up to parallelism DoH servers
-		log.Println( "DoH2: Using", parallelism, "DoH server(s) in iteration", i )
+		log.Println( "DoH2: Using", parallelism, "DoH server(s) in iteration", i, "to verify", ip )
 		
 		dohCtx, cancel := context.WithTimeout( ctx, 5 * time.Second )
 		responses, pErr := d.ParallelDoH( dohCtx, dohServers[:parallelism], name, queryType )														// Resolve name
-		if pErr != nil { cancel(); return nil, pErr }
+		if pErr != nil { cancel(); return false, pErr }
 		
 		for count := 0; count < cap(responses); count ++ {
-			if response := <-responses; response.ip.Equal(ip) { verified = true; successfulServerIndex += response.index; break }					// Got a response which matches the ip returned in the first phase
+			if response := <-responses; slices.ContainsFunc( response.ips, ip.Equal ) { verified = true; break }									// Got a response which matches the ip returned in the first phase
 		}
 		cancel()																																	// Cancel all the other parallel DoH queries
-		if verified { break }
+		if verified { return }
 		
 		dohServers = dohServers[parallelism:]																										// None of the used DoH servers provided an answer, skip them in the next iteration
-		successfulServerIndex += parallelism																										// the next iteration
 	}
-	if !verified { log.Println( "DoH2: [ERR] Could not verify", ip ); ip = nil; return }
+	log.Println( "DoH2: [ERR] Could not verify", ip )
 	return
 }
 
 func ( d *Resolver ) Resolve( ctx context.Context, name string ) ( ips []net.IP, err error ) {
-	ip, err := d.ResolveType( ctx, name, dnsmessage.TypeA )
+	aIps, err := d.ResolveType( ctx, name, dnsmessage.TypeA )
 	if err != nil { return }
-	if ip != nil { ips = append( ips, ip ) }
-	ip, err = d.ResolveType( ctx, name, dnsmessage.TypeAAAA )
+	aaaaIps, err := d.ResolveType( ctx, name, dnsmessage.TypeAAAA )
 	if err != nil { return }
-	if ip != nil { ips = append( ips, ip ) }
-	return
-}
\ No newline at end of file
+	return append( aIps, aaaaIps... ), nil
+}
+
+// ResolveVerified resolves name like Resolve does, hideservers.net addresses are verified unless NoVerify patterns exclude name
+func ( d *Resolver ) ResolveVerified( ctx context.Context, name string ) ( ips []net.IP, verified bool, err error ) {
+	if ips, err = d.Resolve( ctx, name ); err != nil { return }
+	fqdn := strings.TrimSuffix( name, "." ) + "."
+	return ips, strings.HasSuffix( fqdn, ".hideservers.net." ) && !d.skipVerification( fqdn ), nil
+}
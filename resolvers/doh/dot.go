@@ -0,0 +1,99 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/jedisct1/go-dnsstamps"
+)
+
+const dotDefaultPort = "853"
+
+// parseStamp parses a DNS stamp. The dnsstamps package does not support DNS-over-TLS stamps, so those get parsed here
+func parseStamp( stampStr string ) ( stamp dnsstamps.ServerStamp, err error ) {
+	bin, err := base64.RawURLEncoding.Strict().DecodeString( strings.TrimPrefix( stampStr, "sdns://" ) )
+	if err != nil { return }
+	if len( bin ) == 0 || bin[0] != uint8( dnsstamps.StampProtoTypeTLS ) { return dnsstamps.NewServerStampFromString( stampStr ) }
+	return parseDoTStamp( bin )
+}
+
+// parseDoTStamp parses the binary DNS-over-TLS stamp: 0x03 || props || LP(addr) || VLP(hashes) || LP(hostname) [ || VLP(bootstrap IPs) ]
+func parseDoTStamp( bin []byte ) ( stamp dnsstamps.ServerStamp, err error ) {
+	stamp.Proto = dnsstamps.StampProtoTypeTLS
+	if len( bin ) < 12 { err = errors.New( "stamp is too short" ); return }
+	stamp.Props = dnsstamps.ServerInformalProperties( binary.LittleEndian.Uint64( bin[1:9] ) )
+	pos := 9
+	next := func() ( field []byte, more bool, err error ) {																				// Reads a length prefixed field, the high bit of the length marks more fields of a set
+		if pos >= len( bin ) { err = errors.New( "invalid stamp" ); return }
+		length := int( bin[pos] &^ 0x80 )
+		more = bin[pos] & 0x80 != 0
+		if pos + 1 + length > len( bin ) { err = errors.New( "invalid stamp" ); return }
+		field, pos = bin[pos + 1 : pos + 1 + length], pos + 1 + length
+		return
+	}
+
+	addr, _, err := next()
+	if err != nil { return }
+	stamp.ServerAddrStr = string( addr )
+	for more := true; more; {
+		var hash []byte
+		if hash, more, err = next(); err != nil { return }
+		if len( hash ) > 0 { stamp.Hashes = append( stamp.Hashes, hash ) }
+	}
+	hostname, _, err := next()
+	if err != nil { return }
+	stamp.ProviderName = string( hostname )																									// Bootstrap IPs, if any, are not used
+
+	if len( stamp.ServerAddrStr ) > 0 {
+		if _, _, splitErr := net.SplitHostPort( stamp.ServerAddrStr ); splitErr != nil { stamp.ServerAddrStr = net.JoinHostPort( strings.Trim( stamp.ServerAddrStr, "[]" ), dotDefaultPort ) }
+		host, _, _ := net.SplitHostPort( stamp.ServerAddrStr )
+		if net.ParseIP( host ) == nil { err = errors.New( "invalid stamp ( IP address )" ); return }
+	}
+	return
+}
+
+// dotExchange sends a DNS message to a DNS-over-TLS server and reads the response. The server certificate gets verified against the system roots and, when the stamp lists hashes, against those as well
+func ( d *Resolver ) dotExchange( ctx context.Context, stamp dnsstamps.ServerStamp, message []byte ) ( responseBody []byte, err error ) {
+	serverName := stamp.ProviderName
+	if host, _, splitErr := net.SplitHostPort( serverName ); splitErr == nil { serverName = host }
+	endpoint := stamp.ServerAddrStr
+	if len( endpoint ) == 0 { endpoint = net.JoinHostPort( serverName, dotDefaultPort ) }
+
+	del, err := d.throwRoute( "tls://" + serverName, endpoint )																				// Add a throw route when required
+	if err != nil { return }
+	defer del()
+
+	conn, err := d.dialer.DialContext( ctx, "tcp", endpoint )
+	if err != nil { return }
+	tlsConn := tls.Client( conn, &tls.Config{
+		ServerName:	serverName,
+		MinVersion:	tls.VersionTLS12,
+		VerifyConnection: func( state tls.ConnectionState ) error {																			// Stamp hashes are SHA256 digests of the TBS certificates, one of the chain's certificates must match
+			if len( stamp.Hashes ) == 0 { return nil }
+			for _, certificate := range state.PeerCertificates {
+				digest := sha256.Sum256( certificate.RawTBSCertificate )
+				if slices.ContainsFunc( stamp.Hashes, func( hash []byte ) bool { return bytes.Equal( hash, digest[:] ) } ) { return nil }
+			}
+			return errors.New( "certificate does not match the stamp hashes" )
+		},
+	})
+	defer tlsConn.Close()
+	if deadline, ok := ctx.Deadline(); ok { _ = tlsConn.SetDeadline( deadline ) }
+	if err = tlsConn.HandshakeContext( ctx ); err != nil { return }
+
+	if _, err = tlsConn.Write( append( binary.BigEndian.AppendUint16( nil, uint16( len( message ) ) ), message... ) ); err != nil { return }		// RFC 7858 uses the DNS over TCP framing
+	length := make( []byte, 2 )
+	if _, err = io.ReadFull( tlsConn, length ); err != nil { return }
+	responseBody = make( []byte, binary.BigEndian.Uint16( length ) )
+	_, err = io.ReadFull( tlsConn, responseBody )
+	return
+}
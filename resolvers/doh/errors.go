@@ -1,6 +1,11 @@
 package doh
 
-import "strconv"
+import (
+	"errors"
+	"strconv"
+)
+
+var ErrNegativeAnswer = errors.New( "negative answer" )
 
 type ErrHttpStatus int
 func ( e ErrHttpStatus ) Error() string { return "bad HTTP status " + strconv.Itoa( int( e ) ) }
\ No newline at end of file
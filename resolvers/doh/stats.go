@@ -0,0 +1,141 @@
+package doh
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindow = 32																												// Number of recent latencies kept per server
+	explorationRate = 0.1																											// Probability of promoting a random server, lets recovered and untried servers prove themselves
+	failurePenalty = 10 * time.Minute																								// Servers which failed recently get demoted for this long
+)
+
+type serverStats struct {
+	Successes		int					`json:"successes"`
+	Failures		int					`json:"failures"`
+	Latencies		[]time.Duration		`json:"latencies,omitempty"`															// Most recent latencies of successful queries
+	LastFailure		time.Time			`json:"lastFailure,omitzero"`
+	LastError		string				`json:"lastError,omitempty"`
+}
+
+// successRate is the success rate with add-one smoothing, untried servers start at 0.5
+func ( s *serverStats ) successRate() float64 { return float64( s.Successes + 1 ) / float64( s.Successes + s.Failures + 2 ) }
+
+// medianLatency returns the median of the recent latencies, 0 when there are none
+func ( s *serverStats ) medianLatency() time.Duration {
+	if len( s.Latencies ) == 0 { return 0 }
+	sorted := slices.Sorted( slices.Values( s.Latencies ) )
+	return sorted[len( sorted ) / 2]
+}
+
+// score ranks a server, higher is better. The success rate gets scaled down by the median latency ( by half at one second ) and by a recent failure
+func ( s *serverStats ) score( now time.Time ) float64 {
+	score := s.successRate() / ( 1 + s.medianLatency().Seconds() )
+	if now.Sub( s.LastFailure ) < failurePenalty { score /= 2 }
+	return score
+}
+
+// stats keeps per-server health statistics, optionally persisted to disk
+type stats struct {
+	sync.Mutex
+	filename	string
+	servers		map[string]*serverStats
+}
+
+func newStats( filename string ) *stats { return &stats{ filename: filename, servers: map[string]*serverStats{} } }
+
+// get returns the statistics of a server, creating those when missing. Must be called with stats locked
+func ( s *stats ) get( server string ) *serverStats {
+	if serverStats, ok := s.servers[server]; ok { return serverStats }
+	s.servers[server] = &serverStats{}
+	return s.servers[server]
+}
+
+// success records a successful query and its latency
+func ( s *stats ) success( server string, latency time.Duration ) {
+	s.Lock(); defer s.Unlock()
+	serverStats := s.get( server )
+	serverStats.Successes++
+	serverStats.Latencies = append( serverStats.Latencies, latency )
+	if len( serverStats.Latencies ) > latencyWindow { serverStats.Latencies = serverStats.Latencies[len( serverStats.Latencies ) - latencyWindow:] }
+}
+
+// failure records a failed query
+func ( s *stats ) failure( server string, err error ) {
+	s.Lock(); defer s.Unlock()
+	serverStats := s.get( server )
+	serverStats.Failures++
+	serverStats.LastFailure, serverStats.LastError = time.Now(), err.Error()
+}
+
+// order returns the servers sorted by their scores. Each position may get swapped with a random lower ranked server ( exploration )
+func ( s *stats ) order( servers []string ) ( ordered []string ) {
+	s.Lock()
+	now, scores := time.Now(), make( map[string]float64, len( servers ) )
+	for _, server := range servers { scores[server] = s.get( server ).score( now ) }
+	s.Unlock()
+	
+	ordered = slices.Clone( servers )
+	rand.Shuffle( len( ordered ), func( i, j int ) { ordered[i], ordered[j] = ordered[j], ordered[i] } )										// Servers of equal scores appear in random order
+	slices.SortStableFunc( ordered, func( a, b string ) int { return cmp.Compare( scores[b], scores[a] ) } )
+	for i := 0; i < len( ordered ) - 1; i++ {
+		if rand.Float64() >= explorationRate { continue }
+		j := i + 1 + rand.Intn( len( ordered ) - i - 1 )
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	}
+	return
+}
+
+// prune drops the statistics of servers which are not listed anymore
+func ( s *stats ) prune( servers []string ) {
+	s.Lock(); defer s.Unlock()
+	for server := range s.servers { if !slices.Contains( servers, server ) { delete( s.servers, server ) } }
+}
+
+// load reads the persisted statistics
+func ( s *stats ) load() {
+	if len( s.filename ) == 0 { return }
+	content, err := os.ReadFile( s.filename )
+	if err != nil { if !errors.Is( err, os.ErrNotExist ) { log.Println( "Init: [ERR] Read DoH statistics", s.filename, "failed:", err ) }; return }
+	s.Lock(); defer s.Unlock()
+	if err = json.Unmarshal( content, &s.servers ); err != nil { log.Println( "Init: [ERR] Parse DoH statistics", s.filename, "failed:", err ); s.servers = map[string]*serverStats{}; return }
+	log.Println( "Init: Loaded statistics of", len( s.servers ), "DoH servers from", s.filename )
+}
+
+// save persists the statistics
+func ( s *stats ) save() {
+	if len( s.filename ) == 0 { return }
+	s.Lock()
+	content, err := json.Marshal( s.servers )
+	s.Unlock()
+	if err != nil { return }
+	if err = os.WriteFile( s.filename, content, 0600 ); err != nil { log.Println( "DoHs: [ERR] Write DoH statistics", s.filename, "failed:", err ) }
+}
+
+// PrintStats prints the statistics of the DoH servers, best ranked first
+func ( d *Resolver ) PrintStats() {
+	servers := slices.Clone( d.servers() )
+	d.stats.Lock()
+	now := time.Now()
+	slices.SortStableFunc( servers, func( a, b string ) int { return cmp.Compare( d.stats.get( b ).score( now ), d.stats.get( a ).score( now ) ) } )
+	fmt.Printf( "%-50s | %8s | %8s | %8s | %s\n", "Server", "Queries", "Success", "Median", "Last failure" )
+	fmt.Printf( "%-50s | %8s | %8s | %8s | %s\n", "------", "-------", "-------", "------", "------------" )
+	for _, server := range servers {
+		serverStats, name := d.stats.get( server ), server
+		if stamp, err := parseStamp( server ); err == nil { name = stamp.ProviderName + stamp.Path }
+		total, successRate, lastFailure := serverStats.Successes + serverStats.Failures, "-", "-"
+		if total > 0 { successRate = fmt.Sprintf( "%.0f%%", float64( serverStats.Successes ) * 100 / float64( total ) ) }
+		if !serverStats.LastFailure.IsZero() { lastFailure = serverStats.LastFailure.Format( time.DateTime ) + " ( " + serverStats.LastError + " )" }
+		fmt.Printf( "%-50s | %8d | %8s | %8s | %s\n", name, total, successRate, serverStats.medianLatency().Round( time.Millisecond ), lastFailure )
+	}
+	d.stats.Unlock()
+}
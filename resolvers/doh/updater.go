@@ -2,30 +2,37 @@ package doh
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
+	"github.com/eventure/hide.client.linux/atomicfile"
+	"github.com/eventure/hide.client.linux/minisign"
 	"github.com/jedisct1/go-dnsstamps"
 	"github.com/vishvananda/netlink"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
 
-// ParseDnsStamps parses DNS stamps read from a reader, checks if they're of DoH type and checks if the IPs associated to those DoH servers can be reached
+// ParseDnsStamps parses DNS stamps read from a reader, checks if they're of DoH or DoT type and checks if the IPs associated to those DoH servers can be reached
 func ( d *Resolver ) ParseDnsStamps( reader io.Reader ) ( dohServers []string ) {
 	line, stamp, ip, err := "", dnsstamps.ServerStamp{}, net.IP(nil), error(nil)
 	for scanner := bufio.NewScanner(reader); scanner.Scan(); {
 		line = strings.TrimSpace(scanner.Text())
 		if !strings.HasPrefix(line, "sdns://" ) { continue }
 		
-		if stamp, err = dnsstamps.NewServerStampFromString(line); err != nil { log.Println( "dPrs: [ERR] Parse", line, "failed:", err ); continue }
-		if stamp.Proto != dnsstamps.StampProtoTypeDoH { continue }
-		
-		if len(stamp.ServerAddrStr) == 0 { stamp.ServerAddrStr = stamp.ProviderName + ":443" }
+		if stamp, err = parseStamp(line); err != nil { log.Println( "dPrs: [ERR] Parse", line, "failed:", err ); continue }
+		switch stamp.Proto {																											// DoH and DoT servers only
+			case dnsstamps.StampProtoTypeDoH: if len(stamp.ServerAddrStr) == 0 { stamp.ServerAddrStr = stamp.ProviderName + ":443" }
+			case dnsstamps.StampProtoTypeTLS: if len(stamp.ServerAddrStr) == 0 { stamp.ServerAddrStr = stamp.ProviderName + ":" + dotDefaultPort }
+			default: continue
+		}
 		host, _, err := net.SplitHostPort(stamp.ServerAddrStr)
 		if err != nil { log.Println( "dPrs: Split host:port failed on", stamp.ServerAddrStr, "for", stamp.ProviderName, "with:", err ); continue }
 		
@@ -37,43 +44,121 @@ func ( d *Resolver ) ParseDnsStamps( reader io.Reader ) ( dohServers []string )
 	return
 }
 
-// Update fetches DNS stamp lists and filters them to remove non-DoH servers and/or network family incompatible DoH servers
+// updateSource is the state of an update URL as of the last successful download
+type updateSource struct {
+	ETag			string		`json:"etag,omitempty"`
+	LastModified	string		`json:"lastModified,omitempty"`
+	Stamps			[]string	`json:"stamps,omitempty"`																	// Stamps of the last verified list
+}
+
+// parseStampList extracts DNS stamps out of a resolver list. Lists may be in the markdown format ( stamps on separate lines ) or in the JSON format ( an array of objects with "stamp" attributes )
+func parseStampList( list []byte ) ( stamps []string, err error ) {
+	if trimmed := bytes.TrimSpace( list ); len( trimmed ) > 0 && trimmed[0] == '[' {
+		entries := []struct{ Stamp string `json:"stamp"` }(nil)
+		if err = json.Unmarshal( trimmed, &entries ); err != nil { return }
+		for _, entry := range entries { if strings.HasPrefix( entry.Stamp, "sdns://" ) { stamps = append( stamps, entry.Stamp ) } }
+		return
+	}
+	for scanner := bufio.NewScanner( bytes.NewReader( list ) ); scanner.Scan(); {
+		if line := strings.TrimSpace( scanner.Text() ); strings.HasPrefix( line, "sdns://" ) { stamps = append( stamps, line ) }
+	}
+	return
+}
+
+// Update fetches DNS stamp lists, merges and deduplicates the stamps and replaces the resolvers file atomically
+// Each list must come with a minisign signature ( the update URL with .minisig appended ) made by the configured key. Conditional requests ( ETag and Last-Modified ) skip unchanged lists
+// When a list can't be downloaded or verified the stamps of its last verified version are used, the previous file is kept when there are none
 func ( d *Resolver ) Update() ( err error ) {
 	if len(d.Config.Filename) == 0 { err = errors.New("no filename"); log.Println( "dUpd: [ERR] Failed:", err ); return }
 	if len(d.Config.UpdateURLs) == 0 { return }
+	var key *minisign.Key
+	if len(d.Config.MinisignKey) > 0 {
+		if key, err = minisign.ParseKey( d.Config.MinisignKey ); err != nil { log.Println( "dUpd: [ERR] Minisign key:", err ); return }
+	} else { log.Println( "dUpd: [WARN] No minisign key configured, resolver lists won't be verified" ) }
 	httpClient := &http.Client{Transport: &http.Transport{ DisableKeepAlives: true, ForceAttemptHTTP2: true }, Timeout: 5 * time.Second }
-	var request *http.Request
-	var response *http.Response
-	var file *os.File
+	download := func( url string, previous *updateSource ) ( body []byte, headers http.Header, notModified bool, err error ) {
+		request, err := http.NewRequest( "GET", url, nil )
+		if err != nil { return }
+		if previous != nil && len( previous.Stamps ) > 0 {																		// Conditional request, only when there's a previous version to fall back to
+			if len( previous.ETag ) > 0 { request.Header.Set( "If-None-Match", previous.ETag ) }
+			if len( previous.LastModified ) > 0 { request.Header.Set( "If-Modified-Since", previous.LastModified ) }
+		}
+		response, err := httpClient.Do( request )
+		if err != nil { return }
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotModified { notModified = true; return }
+		if response.StatusCode != http.StatusOK { err = ErrHttpStatus( response.StatusCode ); return }
+		body, err = io.ReadAll( response.Body )
+		return body, response.Header, false, err
+	}
 	
+	sources, changed, checked := d.loadUpdateState(), false, 0																		// checked counts the sources which have been fetched and verified or reported as not modified
+	stamps, seen := []string(nil), map[string]bool{}
 	for _, source := range d.Config.UpdateURLs {
-		log.Println( "dUpd: Downloading resolver list from", source )
-		if request, err = http.NewRequest( "GET", source, nil ); err != nil { log.Println( "dUpd: [ERR] Resolvers update failed:", err ); return }
-		if response, err = httpClient.Do( request ); err != nil { log.Println( "dUpd: [ERR] Resolvers update failed:", err ); continue }
-		if response.StatusCode != 200 { log.Println( "dUpd: [ERR] Resolvers update from", source, "failed with status code", response.StatusCode ); continue }
-		defer response.Body.Close()
+		previous := sources[source]
+		add := func( sourceStamps []string ) { for _, stamp := range sourceStamps { if !seen[stamp] { seen[stamp] = true; stamps = append( stamps, stamp ) } } }	// Stamps listed by multiple sources are kept once
+		usePrevious := func() {
+			if previous == nil || len( previous.Stamps ) == 0 { return }
+			log.Println( "dUpd: Using", len( previous.Stamps ), "previously verified stamps from", source )
+			add( previous.Stamps )
+		}
 		
-		if file == nil {
-			if file, err = os.Create(d.Config.Filename); err != nil { log.Println( "dUpd: [ERR] Create", d.Config.Filename, "failed:", err ); return }
-			defer func() { log.Println( "dUpd: Resolvers stored in", d.Config.Filename ); _ = file.Close() } ()
+		log.Println( "dUpd: Downloading resolver list from", source )
+		list, headers, notModified, dErr := download( source, previous )
+		if dErr != nil { log.Println( "dUpd: [ERR] Resolvers update from", source, "failed:", dErr ); usePrevious(); continue }
+		if notModified { log.Println( "dUpd: Resolver list from", source, "has not been modified" ); checked++; usePrevious(); continue }
+		if key != nil {
+			signature, _, _, sErr := download( source + ".minisig", nil )
+			if sErr != nil { log.Println( "dUpd: [ERR] Signature download from", source + ".minisig", "failed:", sErr ); usePrevious(); continue }
+			if vErr := key.Verify( list, signature ); vErr != nil { log.Println( "dUpd: [ERR] Resolver list from", source, "rejected:", vErr ); usePrevious(); continue }
+			log.Println( "dUpd: Signature of", source, "verified" )
 		}
-		if _, err = io.Copy(file, response.Body); err != nil { log.Println( "dUpd: Write", d.Config.Filename, "failed:", err ); return }
-		if _, err = file.Write( []byte{'\n'} ); err != nil { log.Println( "dUpd: Write (newline)", d.Config.Filename, "failed:", err ); return }
+		listStamps, pErr := parseStampList( list )
+		if pErr != nil || len( listStamps ) == 0 { log.Println( "dUpd: [ERR] No stamps in the resolver list from", source, pErr ); usePrevious(); continue }
+		
+		sources[source], changed, checked = &updateSource{ ETag: headers.Get( "ETag" ), LastModified: headers.Get( "Last-Modified" ), Stamps: listStamps }, true, checked + 1
+		add( listStamps )
+	}
+	if len( stamps ) == 0 || checked == 0 { err = errors.New( "no resolver list could be downloaded and verified" ); log.Println( "dUpd: [ERR] Keeping", d.Config.Filename, "since", err ); return }
+	if _, statErr := os.Stat( d.Config.Filename ); !changed && statErr == nil {
+		log.Println( "dUpd: Resolvers in", d.Config.Filename, "are up to date" )
+		_ = os.Chtimes( d.Config.Filename, time.Now(), time.Now() )																// The modification time tells when the list has been checked last
+		return
 	}
+	
+	if err = atomicfile.Write( d.Config.Filename, []byte( strings.Join( stamps, "\n" ) + "\n" ) ); err != nil { log.Println( "dUpd: [ERR] Write", d.Config.Filename, "failed:", err ); return }
+	log.Println( "dUpd:", len( stamps ), "resolvers stored in", d.Config.Filename )
+	for source := range sources { if !slices.Contains( d.Config.UpdateURLs, source ) { delete( sources, source ) } }							// Forget the sources which are not configured anymore
+	d.saveUpdateState( sources )
 	return
 }
 
-func ( d *Resolver ) RandomizeOrder() {
-	for i := 0; i < len(d.dohServers); i++ {
-		j := rand.Intn( len(d.dohServers) )
-		d.dohServers[i], d.dohServers[j] = d.dohServers[j], d.dohServers[i]
-	}
+// loadUpdateState reads the state of the update URLs
+func ( d *Resolver ) loadUpdateState() ( sources map[string]*updateSource ) {
+	sources = map[string]*updateSource{}
+	content, err := os.ReadFile( d.siblingFilename( ".update.json" ) )
+	if err != nil { if !errors.Is( err, os.ErrNotExist ) { log.Println( "dUpd: [ERR] Read update state failed:", err ) }; return }
+	if err = json.Unmarshal( content, &sources ); err != nil { log.Println( "dUpd: [ERR] Parse update state failed:", err ); return map[string]*updateSource{} }
+	return
+}
+
+// saveUpdateState persists the state of the update URLs
+func ( d *Resolver ) saveUpdateState( sources map[string]*updateSource ) {
+	content, err := json.Marshal( sources )
+	if err != nil { return }
+	if err = atomicfile.Write( d.siblingFilename( ".update.json" ), content ); err != nil { log.Println( "dUpd: [ERR] Write update state failed:", err ) }
+}
+
+// siblingFilename returns the name of a file kept next to the resolvers file ( resolvers.txt gets resolvers.stats.json for the .stats.json suffix )
+func ( d *Resolver ) siblingFilename( suffix string ) string {
+	if len( d.Config.Filename ) == 0 { return "" }
+	return strings.TrimSuffix( d.Config.Filename, filepath.Ext( d.Config.Filename ) ) + suffix
 }
 
 func ( d *Resolver ) Dump() ( err error ) {
 	stamp := dnsstamps.ServerStamp{}
-	for _, dohServer := range d.dohServers {
-		if stamp, err = dnsstamps.NewServerStampFromString(dohServer); err != nil { log.Println( "dump: [ERR] Parse", dohServer, "failed:", err ); continue }
+	for _, dohServer := range d.servers() {
+		if stamp, err = parseStamp(dohServer); err != nil { log.Println( "dump: [ERR] Parse", dohServer, "failed:", err ); continue }
 		log.Println( "dump:", stamp.ProviderName + stamp.Path, stamp.ServerAddrStr, "-", dohServer)
 	}
 	return
@@ -0,0 +1,25 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+// HostMap holds statically configured addresses by host names, it resolves names without any DNS traffic
+type HostMap map[string][]string
+
+func ( h HostMap ) Resolve( _ context.Context, name string ) ( ips []net.IP, err error ) {
+	name = strings.TrimSuffix( name, "." )
+	for host, addresses := range h {
+		if !strings.EqualFold( strings.TrimSuffix( host, "." ), name ) { continue }
+		for _, address := range addresses {
+			if ip := net.ParseIP( address ); ip != nil { ips = append( ips, ip ); continue }
+			log.Println( "Name: [ERR] Bad static address", address, "for", host )
+		}
+	}
+	if len( ips ) == 0 { err = errors.New( "no static addresses" ) }
+	return
+}
@@ -2,27 +2,50 @@ package plain
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"io"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 	
+	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/sys/unix"
 )
 
+const (
+	staggerDelay = 500 * time.Millisecond														// Delay between the starts of queries to different servers
+	failurePenalty = 5 * time.Minute															// Servers which failed recently are tried last for this long
+	maxCnameChain = 8																			// Longest CNAME chain followed within an answer
+	System = "system"																			// Server list entry which stands for the nameservers of the original resolv.conf
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+var ErrNotFound = errors.New( "name not found" )
+var ErrNotVerified = errors.New( "verification failed" )
+
 type RouteOps interface {
 	ThrowRouteAdd( logPrefix string, dst *net.IPNet ) ( err error )
 	ThrowRouteDel( logPrefix string, dst *net.IPNet ) ( err error )
 }
 
 type Config struct {
-	Servers		[]string		`yaml:"servers,omitempty"`										// DNS server IP addresses
+	Servers					[]string	`yaml:"servers,omitempty"`								// DNS server IP addresses, optionally with ports ( IPv6 addresses with ports must be enclosed in brackets ), or "system"
+	RequireVerification		bool		`yaml:"requireVerification,omitempty"`					// Reject hideservers.net answers which could not be verified through the dash-encoded names
 }
 
 type Resolver struct {
 	*Config
+	sync.Mutex
+	servers		[]string																		// Server endpoints ( ip:port ) or System
+	resolvConf	func() ( []byte, error )														// Provides the original resolv.conf content for the System entry
+	failed		map[string]time.Time															// Servers which failed recently, by their endpoints
 	dialer		*net.Dialer
 	mark		int
 	routeOps	RouteOps
@@ -31,10 +54,25 @@ type Resolver struct {
 func New( config *Config ) *Resolver { if config == nil { config = &Config{} }; return &Resolver{ Config: config } }
 func (d *Resolver) SetRouteOps(routeOps RouteOps) { d.routeOps = routeOps }
 func (d *Resolver) SetMark(mark int) { d.mark = mark }
+func (d *Resolver) SetResolvConf(resolvConf func() ( []byte, error )) { d.resolvConf = resolvConf }
+
+// endpoint converts a server address to an ip:port endpoint, port 53 is used when the address has no port
+func endpoint( server string ) ( string, error ) {
+	if ip := net.ParseIP( strings.Trim( server, "[]" ) ); ip != nil { return net.JoinHostPort( ip.String(), "53" ), nil }
+	host, port, err := net.SplitHostPort( server )
+	if err != nil { return "", err }
+	ip := net.ParseIP( host )
+	if ip == nil { return "", errors.New( "not an IP address" ) }
+	return net.JoinHostPort( ip.String(), port ), nil
+}
 
 func (d *Resolver) Init() ( err error ) {
+	d.servers, d.failed = nil, map[string]time.Time{}
 	for _, server := range d.Servers {
-		if _, addrErr := net.ResolveUDPAddr("udp", server); addrErr != nil { log.Println( "Init: Bad DNS server endpoint", server ); return addrErr }
+		if server == System { d.servers = append( d.servers, System ); continue }				// Nameservers get read from resolv.conf on each lookup as those may change ( DHCP )
+		serverEndpoint, addrErr := endpoint( server )
+		if addrErr != nil { log.Println( "Init: Bad DNS server endpoint", server ); return addrErr }
+		d.servers = append( d.servers, serverEndpoint )
 	}
 	d.dialer = &net.Dialer{																		// Use a custom dialer to set the socket mark on sockets when those are configured
 		Control: func( network, address string, rawConn syscall.RawConn ) ( err error ) {
@@ -45,30 +83,245 @@ func (d *Resolver) Init() ( err error ) {
 			return
 		},
 	}
-	log.Println( "Init: Using", len( d.Config.Servers ), "DNS servers")
+	log.Println( "Init: Using", len( d.servers ), "DNS servers")
+	return
+}
+
+// systemServers returns the endpoints of the nameservers listed in the original resolv.conf. Zones of IPv6 link-local addresses are kept
+func ( d *Resolver ) systemServers() ( servers []string ) {
+	resolvConf := d.resolvConf
+	if resolvConf == nil { resolvConf = func() ( []byte, error ) { return os.ReadFile( resolvConfPath ) } }
+	content, err := resolvConf()
+	if err != nil { log.Println( "Name: [ERR] System nameservers unavailable:", err ); return }
+	for line := range strings.Lines( string( content ) ) {
+		fields := strings.Fields( line )
+		if len( fields ) < 2 || fields[0] != "nameserver" { continue }
+		address, zone, _ := strings.Cut( fields[1], "%" )
+		ip := net.ParseIP( address )
+		if ip == nil { continue }
+		if len( zone ) > 0 { zone = "%" + zone }
+		servers = append( servers, net.JoinHostPort( ip.String() + zone, "53" ) )
+	}
+	if len( servers ) == 0 { log.Println( "Name: [ERR] No system nameservers found" ) }
 	return
 }
 
+// order returns the servers in random order, the servers which failed recently come last. The System entry gets replaced by the system nameservers
+func ( d *Resolver ) order() ( servers []string ) {
+	for _, server := range d.servers {
+		switch server {
+			case System:	servers = append( servers, d.systemServers()... )
+			default:		servers = append( servers, server )
+		}
+	}
+	servers = slices.Compact( slices.Sorted( slices.Values( servers ) ) )							// Drop the duplicates, the order gets randomized anyway
+	rand.Shuffle( len( servers ), func( i, j int ) { servers[i], servers[j] = servers[j], servers[i] } )
+	d.Lock(); defer d.Unlock()
+	recentlyFailed := func( server string ) bool { failedAt, ok := d.failed[server]; return ok && time.Since( failedAt ) < failurePenalty }
+	slices.SortStableFunc( servers, func( a, b string ) int {
+		switch aFailed, bFailed := recentlyFailed( a ), recentlyFailed( b ); {
+			case aFailed == bFailed:	return 0
+			case aFailed:				return 1
+			default:					return -1
+		}
+	})
+	return
+}
+
+// health records whether a server answered or not
+func ( d *Resolver ) health( server string, answered bool ) {
+	d.Lock(); defer d.Unlock()
+	if answered { delete( d.failed, server ) } else { d.failed[server] = time.Now() }
+}
+
+// Resolve asks the DNS servers for the A and AAAA records of name, see ResolveVerified
 func ( d *Resolver ) Resolve( ctx context.Context, name string ) ( ips []net.IP, err error ) {
-	if len(d.Config.Servers) == 0 { err = errors.New( "empty DNS server list" ); return }
+	ips, _, err = d.ResolveVerified( ctx, name )
+	return
+}
+
+// ResolveVerified asks the DNS servers for the A and AAAA records of name. hideservers.net answers get verified by asking another server, when there is one, for the dash-encoded addresses
+// Only the verified addresses are returned. When none could be verified all of them are returned as unverified, unless verification is required
+func ( d *Resolver ) ResolveVerified( ctx context.Context, name string ) ( ips []net.IP, verified bool, err error ) {
+	if !strings.HasSuffix( name, "." ) { name += "." }
+	ips, answered, err := d.resolve( ctx, name )
+	if err != nil || !strings.HasSuffix( name, ".hideservers.net." ) { return }
+	
+	verifiedIps := d.verify( ctx, answered, ips )
+	switch {
+		case len( verifiedIps ) > 0:		return verifiedIps, true, nil
+		case d.Config.RequireVerification:	log.Println( "Name: [ERR] Could not verify", ips, "of", strings.TrimSuffix( name, "." ) ); return nil, false, ErrNotVerified
+		default:							log.Println( "Name: [WARN] Using unverified", ips, "of", strings.TrimSuffix( name, "." ) ); return ips, false, nil
+	}
+}
+
+// verify keeps the addresses which the dash-encoded names resolve to. The servers other than the one which answered get asked first, the next server gets asked when one does not respond
+func ( d *Resolver ) verify( ctx context.Context, answered string, ips []net.IP ) ( verified []net.IP ) {
+	verifiers := slices.DeleteFunc( d.order(), func( server string ) bool { return server == answered } )
+	verifiers = append( verifiers, answered )															// The server which answered is the last resort
+	
+	ctx, cancel := context.WithTimeout( ctx, time.Second * 5 )
+	defer cancel()
+	for _, ip := range ips {
+		name, queryType := strings.ReplaceAll( ip.String(), ".", "-" ) + ".hideservers.net.", dnsmessage.TypeA			// Construct the name as a dash-encoded IP address
+		if ip.To4() == nil { name, queryType = strings.ReplaceAll( ip.String(), ":", "-" ) + "-v6.hideservers.net.", dnsmessage.TypeAAAA }
+		for _, verifier := range verifiers {
+			dashIps, dashErr := d.queryRouted( ctx, verifier, name, queryType )
+			if dashErr != nil && !errors.Is( dashErr, ErrNotFound ) { log.Println( "Name: [ERR] DNS server", verifier, "failed to verify", ip, dashErr ); if ctx.Err() != nil { return }; continue }
+			if slices.ContainsFunc( dashIps, ip.Equal ) { verified = append( verified, ip ); log.Println( "Name:", ip, "verified by", verifier ) }
+			break
+		}
+	}
+	return
+}
+
+// resolve asks the DNS servers for the A and AAAA records of name. A query to the next server starts every staggerDelay, or right away when the previous one fails. The first server to answer wins
+func ( d *Resolver ) resolve( ctx context.Context, name string ) ( ips []net.IP, answered string, err error ) {
+	servers := d.order()
+	if len( servers ) == 0 { err = errors.New( "empty DNS server list" ); return }
 	
-	endpoint := d.Config.Servers[ rand.Intn( len(d.Config.Servers) ) ]							// Random DNS server
-	resolver := &net.Resolver{ PreferGo: true, Dial: func(ctx context.Context, network string, addr string) (net.Conn, error) { return d.dialer.DialContext( ctx, network, endpoint ) } }
+	ctx, cancel := context.WithTimeout( ctx, time.Second * 5 )
+	defer cancel()																				// Cancel the queries still in progress once there's an answer
+	type result struct {
+		server		string
+		ips			[]net.IP
+		healthy		bool
+		err			error
+	}
+	results := make( chan result, len( servers ) )
+	timer := time.NewTimer( 0 )
+	defer timer.Stop()
+	for started, failed := 0, 0; ; {
+		select {
+			case <-timer.C:
+				if started == len( servers ) { break }
+				go func( server string ) { serverIps, healthy, serverErr := d.resolveWith( ctx, server, name ); results <- result{ server, serverIps, healthy, serverErr } }( servers[started] )
+				started++
+				timer.Reset( staggerDelay )
+			case r := <-results:
+				answered := r.err == nil || errors.Is( r.err, ErrNotFound )							// A server which says that a name does not exist has answered
+				d.health( r.server, answered || r.healthy )												// An AAAA only failure doesn't count against the server
+				if answered { return r.ips, r.server, r.err }
+				log.Println( "Name: [ERR] DNS server", r.server, "failed:", r.err )
+				if failed++; failed == len( servers ) { return nil, "", r.err }
+				if started < len( servers ) { timer.Reset( 0 ) }								// Ask the next server right away
+			case <-ctx.Done():
+				log.Println( "Name: [ERR]", strings.TrimSuffix( name, "." ), "lookup failed:", ctx.Err() )
+				return nil, "", ctx.Err()
+		}
+	}
+}
+
+// throwRoute adds a throw route towards a server when required, del removes it
+func ( d *Resolver ) throwRoute( server string ) ( del func(), err error ) {
+	del = func() {}
+	if d.routeOps == nil { return }
+	host, _, _ := net.SplitHostPort( server )
+	host, _, _ = strings.Cut( host, "%" )
+	ip := net.ParseIP( host )
+	if ip == nil { return }
+	mask := net.CIDRMask( 128, 128 )
+	if ip4 := ip.To4(); ip4 != nil { ip, mask = ip4, net.CIDRMask( 32, 32 ) }
+	if err = d.routeOps.ThrowRouteAdd( "DNS server " + server, &net.IPNet{ IP: ip, Mask: mask } ); err != nil { return }
+	return func() { _ = d.routeOps.ThrowRouteDel( "DNS server " + server, &net.IPNet{ IP: ip, Mask: mask } ) }, nil
+}
+
+// queryRouted sends a single query to a server, like query does, with a throw route towards the server in place
+func ( d *Resolver ) queryRouted( ctx context.Context, server string, name string, queryType dnsmessage.Type ) ( ips []net.IP, err error ) {
+	del, err := d.throwRoute( server )
+	if err != nil { return }
+	defer del()
+	return d.query( ctx, server, name, queryType )
+}
+
+// resolveWith asks a single DNS server for the A and AAAA records of name. The addresses of one type are returned even when the query for the other type fails, healthy is false when the A query fails
+func ( d *Resolver ) resolveWith( ctx context.Context, server string, name string ) ( ips []net.IP, healthy bool, err error ) {
+	del, err := d.throwRoute( server )
+	if err != nil { return }
+	defer del()
 	
-	if d.routeOps != nil {																		// Add a throw route when required
-		host, _, _ := net.SplitHostPort(endpoint)
-		if ip := net.ParseIP(host); ip != nil {
-			mask := net.CIDRMask(128,128)
-			if ip4 := ip.To4(); ip4 != nil { ip, mask = ip4, net.CIDRMask(32,32) }
-			if err = d.routeOps.ThrowRouteAdd( "DNS server " + endpoint, &net.IPNet{ IP: ip, Mask: mask } ); err != nil { return nil, err }
-			defer d.routeOps.ThrowRouteDel( "DNS server " + endpoint, &net.IPNet{ IP: ip, Mask: mask } )
+	notFound, failed, healthy, failedType := 0, 0, true, ""												// failedType is the type of the last failed query, err its error
+	for _, queryType := range []dnsmessage.Type{ dnsmessage.TypeA, dnsmessage.TypeAAAA } {
+		typeIps, typeErr := d.query( ctx, server, name, queryType )
+		switch {
+			case errors.Is( typeErr, ErrNotFound ):	notFound++
+			case typeErr != nil:
+				failed, failedType, err = failed + 1, strings.TrimPrefix( queryType.String(), "Type" ), typeErr
+				if queryType == dnsmessage.TypeA { healthy = false }
+			default:								ips = append( ips, typeIps... )
 		}
 	}
+	switch {
+		case failed == 2:		ips = nil																// Both queries failed
+		case len( ips ) > 0:
+			if failed == 1 { log.Println( "Name: [WARN] DNS server", server, "failed to resolve the", failedType, "records of", strings.TrimSuffix( name, "." ) + ":", err ) }
+			err = nil
+		case notFound > 0:		err = ErrNotFound														// The name does not exist, whatever the type
+	}
+	return
+}
+
+// query sends a query to a DNS server over UDP, or over TCP when the response was truncated, and returns the addresses of the answer. CNAME chains within the answer get followed
+func ( d *Resolver ) query( ctx context.Context, server string, name string, queryType dnsmessage.Type ) ( ips []net.IP, err error ) {
+	qname, err := dnsmessage.NewName( name )
+	if err != nil { return }
+	id := uint16( rand.Uint32() )
+	query, err := ( &dnsmessage.Message{
+		Header:		dnsmessage.Header{ ID: id, RecursionDesired: true },
+		Questions:	[]dnsmessage.Question{ { Name: qname, Type: queryType, Class: dnsmessage.ClassINET } },
+	}).Pack()
+	if err != nil { return }
 	
-	dnsCtx, cancel := context.WithTimeout( ctx, time.Second * 5 )
-	addrs, err := resolver.LookupIPAddr( dnsCtx, name )
-	cancel()
-	if err != nil { log.Println( "Name: [ERR]", name, "lookup failed:", err ); return }
-	for _, addr := range addrs { if addr.IP == nil { continue }; ips = append( ips, addr.IP ) }
+	msg := dnsmessage.Message{}
+	for _, network := range []string{ "udp", "tcp" } {
+		response, transportErr := d.transport( ctx, network, server, query )
+		if transportErr != nil { return nil, transportErr }
+		if err = msg.Unpack( response ); err != nil { return }
+		if !msg.Header.Response || msg.Header.ID != id { return nil, errors.New( "bad response" ) }
+		if !msg.Header.Truncated { break }															// Truncated, retry over TCP
+	}
+	switch msg.Header.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:	return nil, ErrNotFound
+		default:						return nil, errors.New( "bad response code " + msg.Header.RCode.String() )
+	}
+	
+	target := strings.ToLower( name )															// Follow the CNAME chain from name to the canonical name
+	for hops := 0; hops <= maxCnameChain; hops++ {
+		next := ""
+		for _, answer := range msg.Answers {
+			if cname, ok := answer.Body.( *dnsmessage.CNAMEResource ); ok && strings.ToLower( answer.Header.Name.String() ) == target { next = strings.ToLower( cname.CNAME.String() ) }
+		}
+		if len( next ) == 0 { break }
+		target = next
+	}
+	for _, answer := range msg.Answers {
+		if strings.ToLower( answer.Header.Name.String() ) != target || answer.Header.Class != dnsmessage.ClassINET { continue }
+		switch body := answer.Body.( type ) {
+			case *dnsmessage.AResource:		if queryType == dnsmessage.TypeA { ips = append( ips, net.IP( body.A[:] ) ) }
+			case *dnsmessage.AAAAResource:	if queryType == dnsmessage.TypeAAAA { ips = append( ips, net.IP( body.AAAA[:] ) ) }
+		}
+	}
 	return
-}
\ No newline at end of file
+}
+
+// transport sends a message to a DNS server and reads the response, TCP messages are length prefixed
+func ( d *Resolver ) transport( ctx context.Context, network, server string, message []byte ) ( response []byte, err error ) {
+	conn, err := d.dialer.DialContext( ctx, network, server )
+	if err != nil { return }
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok { _ = conn.SetDeadline( deadline ) }
+	if network == "tcp" {
+		if _, err = conn.Write( append( binary.BigEndian.AppendUint16( nil, uint16( len( message ) ) ), message... ) ); err != nil { return }
+		length := make( []byte, 2 )
+		if _, err = io.ReadFull( conn, length ); err != nil { return }
+		response = make( []byte, binary.BigEndian.Uint16( length ) )
+		_, err = io.ReadFull( conn, response )
+		return
+	}
+	if _, err = conn.Write( message ); err != nil { return }
+	buf := make( []byte, 65535 )
+	n, err := conn.Read( buf )
+	if err != nil { return }
+	return buf[:n], nil
+}
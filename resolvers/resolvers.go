@@ -0,0 +1,113 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+const (																										// Resolver names used in resolver chains
+	DoH = "doh"																								// DNS-over-HTTPs ( and DNS-over-TLS ) resolver
+	DnsCrypt = "dnscrypt"																					// DNSCrypt resolver
+	Plain = "plain"																							// Plain DNS resolver ( the system DNS servers included )
+	Previous = "previous"																					// The address resolved previously by the same REST client
+	Hosts = "hosts"																							// Statically configured addresses
+	Cache = "cache"																							// Addresses persisted after earlier successful lookups
+)
+
+var DefaultChain = []string{ Hosts, DoH, DnsCrypt, Plain, Previous, Cache }
+
+var ErrNoResolver = errors.New( "no usable resolver in the chain" )
+var ErrNotVerified = errors.New( "answer not verified" )
+
+// Resolver resolves names to IP addresses
+type Resolver interface {
+	Resolve( ctx context.Context, name string ) ( ips []net.IP, err error )
+}
+
+// Verifier is implemented by resolvers which tell whether the addresses they return have been verified through the dash-encoded hideservers.net names
+type Verifier interface {
+	ResolveVerified( ctx context.Context, name string ) ( ips []net.IP, verified bool, err error )
+}
+
+// Reloader is implemented by resolvers which are able to re-read their server lists, e.g. after a resolver list update
+type Reloader interface {
+	Reload() ( err error )
+}
+
+// Marker is implemented by resolvers which are able to mark the sockets they use
+type Marker interface {
+	SetMark( mark int )
+}
+
+type RouteOps interface {
+	ThrowRouteAdd( logPrefix string, dst *net.IPNet ) ( err error )
+	ThrowRouteDel( logPrefix string, dst *net.IPNet ) ( err error )
+}
+
+// Func is an adapter which allows the use of ordinary functions as resolvers
+type Func func( ctx context.Context, name string ) ( ips []net.IP, err error )
+
+func ( f Func ) Resolve( ctx context.Context, name string ) ( ips []net.IP, err error ) { return f( ctx, name ) }
+
+// Chain resolves names using the resolvers in the order of Names, the first resolver which returns any addresses wins. Names without a resolver get skipped
+type Chain struct {
+	Names				[]string
+	Resolvers			map[string]Resolver
+	RequireVerified		bool																				// Skip the resolvers which return unverified hideservers.net answers, see requiresVerification
+}
+
+// Answer is the outcome of a chain lookup
+type Answer struct {
+	IPs			[]net.IP
+	Resolver	string																						// Name of the resolver which answered
+	Verified	bool																						// Whether the addresses have been verified, see Verifier
+}
+
+func ( c *Chain ) Resolve( ctx context.Context, name string ) ( ips []net.IP, err error ) {
+	answer, err := c.Lookup( ctx, name )
+	return answer.IPs, err
+}
+
+// Lookup resolves name like Resolve does, but tells which resolver answered and whether the answer has been verified
+func ( c *Chain ) Lookup( ctx context.Context, name string ) ( answer Answer, err error ) {
+	err = ErrNoResolver
+	for _, resolverName := range c.Names {
+		resolver, ok := c.Resolvers[resolverName]
+		if !ok || resolver == nil { continue }
+		resolverIps, verified, resolverErr := []net.IP(nil), false, error(nil)
+		switch verifier, ok := resolver.( Verifier ); {
+			case ok:	resolverIps, verified, resolverErr = verifier.ResolveVerified( ctx, name )
+			default:	resolverIps, resolverErr = resolver.Resolve( ctx, name )
+		}
+		if resolverErr == nil && len( resolverIps ) > 0 && !verified && c.requiresVerification( resolverName, name ) { resolverIps, resolverErr = nil, ErrNotVerified }
+		if resolverErr == nil && len( resolverIps ) > 0 {
+			log.Println( "Name:", resolverName, "resolved", name, "to", resolverIps )
+			return Answer{ IPs: resolverIps, Resolver: resolverName, Verified: verified }, nil
+		}
+		if resolverErr == nil { resolverErr = errors.New( "no addresses" ) }
+		log.Println( "Name: [ERR]", resolverName, "failed to resolve", name + ":", resolverErr )
+		err = resolverErr
+		if ctx.Err() != nil { return }
+	}
+	return
+}
+
+// requiresVerification tells whether the answers of resolverName for name have to be verified. Only hideservers.net names can be verified, the statically configured and the previous addresses are trusted
+func ( c *Chain ) requiresVerification( resolverName, name string ) bool {
+	if !c.RequireVerified || resolverName == Hosts || resolverName == Previous { return false }
+	return strings.HasSuffix( strings.TrimSuffix( name, "." ) + ".", ".hideservers.net." )
+}
+
+// Check verifies that all the names of a chain are known
+func Check( names []string ) ( err error ) {
+	for _, name := range names {
+		switch name {
+			case DoH, DnsCrypt, Plain, Previous, Hosts, Cache:
+			default: return errors.New( "unknown resolver " + name + " ( known resolvers are " + strings.Join( DefaultChain, ", " ) + " )" )
+		}
+	}
+	return
+}
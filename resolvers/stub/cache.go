@@ -0,0 +1,78 @@
+package stub
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxTtl = time.Hour																			// Upper TTL limit for cached responses
+
+type cacheEntry struct {
+	response	[]byte
+	stored		time.Time
+	expires		time.Time
+}
+
+// cache keeps DNS responses for as long as their TTLs allow
+type cache struct {
+	sync.Mutex
+	size		int
+	entries		map[dnsmessage.Question]*cacheEntry
+}
+
+func newCache( size int ) *cache { return &cache{ size: size, entries: map[dnsmessage.Question]*cacheEntry{} } }
+
+// ttl finds the lowest TTL in a response, negative responses are cached according to the SOA record ( RFC 2308 )
+func ttl( msg *dnsmessage.Message ) ( ttl time.Duration, ok bool ) {
+	if msg.Header.Truncated { return }
+	switch msg.Header.RCode { case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError: break; default: return }
+	lowest := uint32( maxTtl / time.Second )
+	if len( msg.Answers ) > 0 && msg.Header.RCode == dnsmessage.RCodeSuccess {
+		for _, answer := range msg.Answers { lowest = min( lowest, answer.Header.TTL ) }
+		return time.Duration( lowest ) * time.Second, lowest > 0
+	}
+	for _, authority := range msg.Authorities {														// NXDOMAIN or NODATA
+		if soa, isSoa := authority.Body.( *dnsmessage.SOAResource ); isSoa { return time.Duration( min( lowest, authority.Header.TTL, soa.MinTTL ) ) * time.Second, true }
+	}
+	return
+}
+
+func ( c *cache ) put( question dnsmessage.Question, response []byte ) {
+	if c.size <= 0 { return }
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack( response ); err != nil { return }
+	ttl, ok := ttl( &msg )
+	if !ok { return }
+	now := time.Now()
+	c.Lock(); defer c.Unlock()
+	if len( c.entries ) >= c.size {																// Make room, expired entries go first, random ones afterwards
+		for key, entry := range c.entries { if now.After( entry.expires ) { delete( c.entries, key ) } }
+		for key := range c.entries { if len( c.entries ) < c.size { break }; delete( c.entries, key ) }
+	}
+	c.entries[question] = &cacheEntry{ response: response, stored: now, expires: now.Add( ttl ) }
+}
+
+// get returns a cached response with TTLs reduced by the time spent in the cache
+func ( c *cache ) get( question dnsmessage.Question, id uint16 ) ( response []byte ) {
+	c.Lock()
+	entry, found := c.entries[question]
+	if found && time.Now().After( entry.expires ) { delete( c.entries, question ); found = false }
+	c.Unlock()
+	if !found { return }
+
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack( entry.response ); err != nil { return }
+	msg.Header.ID = id
+	elapsed := uint32( time.Since( entry.stored ) / time.Second )
+	age := func( resources []dnsmessage.Resource ) {
+		for i := range resources {
+			if resources[i].Header.Type == dnsmessage.TypeOPT { continue }							// OPT TTL field carries EDNS flags
+			if resources[i].Header.TTL > elapsed { resources[i].Header.TTL -= elapsed } else { resources[i].Header.TTL = 0 }
+		}
+	}
+	age( msg.Answers ); age( msg.Authorities ); age( msg.Additionals )
+	response, _ = msg.Pack()
+	return
+}
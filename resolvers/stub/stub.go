@@ -0,0 +1,193 @@
+package stub
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type Config struct {
+	Enabled		bool				`yaml:"enabled,omitempty"`										// Run the local DNS forwarder while connected
+	Address		string				`yaml:"address,omitempty"`										// Listen address ( IP:port )
+	Domains		map[string][]string	`yaml:"domains,omitempty"`										// Split DNS, domain suffix ( corp.example, *.local ) to upstream DNS servers
+	CacheSize	int					`yaml:"cacheSize,omitempty"`									// Maximum number of cached responses, 0 disables caching
+}
+
+// Forwarder is a caching local DNS forwarder which forwards queries to the tunnel DNS servers or, for configured suffixes, to other upstreams
+type Forwarder struct {
+	*Config
+	sync.Mutex
+
+	upstreams	[]string																			// Tunnel DNS servers
+	domains		map[string][]string																	// Normalized split DNS configuration
+	refused		map[string]bool																		// Upstreams not routed through the tunnel while leak protection is active
+
+	udpConn		*net.UDPConn
+	tcpListener	net.Listener
+	dialer		*net.Dialer
+	cache		*cache
+}
+
+func New( config *Config ) *Forwarder { if config == nil { config = &Config{} }; return &Forwarder{ Config: config } }
+
+// upstreamAddress adds the default DNS port to an upstream server address when there's none
+func upstreamAddress( server string ) string {
+	if _, _, err := net.SplitHostPort( server ); err == nil { return server }
+	return net.JoinHostPort( strings.Trim( server, "[]" ), "53" )
+}
+
+// Start starts listening on the configured address and forwarding to upstreams. When tunneled is set ( leak protection active ), queries will be forwarded only to upstreams routed through the tunnel
+func ( f *Forwarder ) Start( upstreams []net.IP, tunneled func( ip net.IP ) bool ) ( listen net.IP, err error ) {
+	f.Lock(); defer f.Unlock()
+	if f.udpConn != nil { err = errors.New( "already started" ); return }
+	udpAddr, err := net.ResolveUDPAddr( "udp", f.Config.Address )
+	if err != nil { log.Println( "Stub: [ERR] Bad listen address", f.Config.Address ); return }
+
+	f.upstreams, f.domains, f.refused = nil, map[string][]string{}, map[string]bool{}
+	for _, upstream := range upstreams { f.upstreams = append( f.upstreams, upstreamAddress( upstream.String() ) ) }
+	for suffix, servers := range f.Config.Domains {
+		suffix = strings.ToLower( strings.Trim( strings.TrimPrefix( suffix, "*." ), "." ) ) + "."
+		for _, server := range servers { f.domains[suffix] = append( f.domains[suffix], upstreamAddress( server ) ) }
+	}
+	if tunneled != nil {																								// Leak protection, check where the upstreams are routed to
+		check := func( upstream string ) {
+			host, _, _ := net.SplitHostPort( upstream )
+			if ip := net.ParseIP( host ); ip == nil || !tunneled( ip ) { f.refused[upstream] = true; log.Println( "Stub: [WARN] Upstream", upstream, "is not routed through the tunnel, refusing to forward to it" ) }
+		}
+		for _, upstream := range f.upstreams { check( upstream ) }
+		for _, servers := range f.domains { for _, server := range servers { check( server ) } }
+	}
+
+	if f.udpConn, err = net.ListenUDP( "udp", udpAddr ); err != nil { log.Println( "Stub: [ERR] Listen on", f.Config.Address, "failed:", err ); return }
+	if f.tcpListener, err = net.Listen( "tcp", f.Config.Address ); err != nil { log.Println( "Stub: [ERR] Listen on", f.Config.Address, "failed:", err ); _ = f.udpConn.Close(); f.udpConn = nil; return }
+	f.dialer = &net.Dialer{ Timeout: 2 * time.Second }																	// Forwarded queries must not be marked, they have to go through the tunnel
+	f.cache = newCache( f.Config.CacheSize )
+	go f.serveUdp( f.udpConn )
+	go f.serveTcp( f.tcpListener )
+	log.Println( "Stub: Forwarding DNS queries on", f.Config.Address, "to", f.upstreams )
+	return udpAddr.IP, nil
+}
+
+// Stop stops the forwarder and flushes the cache
+func ( f *Forwarder ) Stop() ( err error ) {
+	f.Lock(); defer f.Unlock()
+	if f.udpConn == nil { return }
+	err = f.udpConn.Close()
+	if tcpErr := f.tcpListener.Close(); err == nil { err = tcpErr }
+	f.udpConn, f.tcpListener, f.cache = nil, nil, nil
+	log.Println( "Stub: Stopped" )
+	return
+}
+
+func ( f *Forwarder ) serveUdp( udpConn *net.UDPConn ) {
+	buf := make( []byte, 65535 )
+	for {
+		n, addr, err := udpConn.ReadFromUDP( buf )
+		if err != nil { if !errors.Is( err, net.ErrClosed ) { log.Println( "Stub: [ERR] UDP read failed:", err ) }; return }
+		query := append( []byte( nil ), buf[:n]... )
+		go func() { if response := f.handle( "udp", query ); response != nil { _, _ = udpConn.WriteToUDP( response, addr ) } }()
+	}
+}
+
+func ( f *Forwarder ) serveTcp( listener net.Listener ) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil { if !errors.Is( err, net.ErrClosed ) { log.Println( "Stub: [ERR] TCP accept failed:", err ) }; return }
+		go func() {
+			defer conn.Close()
+			for {
+				_ = conn.SetDeadline( time.Now().Add( 10 * time.Second ) )
+				query, err := readTcpMessage( conn )
+				if err != nil { return }
+				response := f.handle( "tcp", query )
+				if response == nil { return }
+				if err = writeTcpMessage( conn, response ); err != nil { return }
+			}
+		}()
+	}
+}
+
+func readTcpMessage( conn net.Conn ) ( message []byte, err error ) {
+	length := make( []byte, 2 )
+	if _, err = io.ReadFull( conn, length ); err != nil { return }
+	message = make( []byte, binary.BigEndian.Uint16( length ) )
+	_, err = io.ReadFull( conn, message )
+	return
+}
+
+func writeTcpMessage( conn net.Conn, message []byte ) ( err error ) {
+	_, err = conn.Write( append( binary.BigEndian.AppendUint16( nil, uint16( len( message ) ) ), message... ) )
+	return
+}
+
+// errorResponse creates a response with rcode for a query
+func errorResponse( query *dnsmessage.Message, rcode dnsmessage.RCode ) []byte {
+	response := dnsmessage.Message{
+		Header:		dnsmessage.Header{ ID: query.Header.ID, Response: true, OpCode: query.Header.OpCode, RecursionDesired: query.Header.RecursionDesired, RecursionAvailable: true, RCode: rcode },
+		Questions:	query.Questions,
+	}
+	buf, _ := response.Pack()
+	return buf
+}
+
+// upstreamsFor picks the upstreams for a name, the longest matching split DNS suffix wins
+func ( f *Forwarder ) upstreamsFor( name string ) ( upstreams []string ) {
+	name, upstreams, matched := strings.ToLower( name ), f.upstreams, ""
+	for suffix, servers := range f.domains {
+		if ( name == suffix || strings.HasSuffix( name, "." + suffix ) ) && len( suffix ) > len( matched ) { matched, upstreams = suffix, servers }
+	}
+	return
+}
+
+// handle answers a query from the cache or forwards it
+func ( f *Forwarder ) handle( network string, query []byte ) ( response []byte ) {
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack( query ); err != nil { return nil }
+	if msg.Header.Response { return nil }
+	if len( msg.Questions ) != 1 { return errorResponse( &msg, dnsmessage.RCodeFormatError ) }
+	question := msg.Questions[0]
+
+	f.Lock(); cache, refused, upstreams := f.cache, f.refused, f.upstreamsFor( question.Name.String() ); f.Unlock()
+	if cache == nil { return nil }																						// Stopped
+	if response = cache.get( question, msg.Header.ID ); response != nil { return }
+
+	rcode := dnsmessage.RCodeRefused																					// Refuse when there's no usable upstream
+	for _, upstream := range upstreams {
+		if refused[upstream] { continue }
+		forwarded, err := f.forward( network, upstream, query )
+		if err != nil { log.Println( "Stub: [ERR] Forward", question.Type, "for", question.Name.String(), "to", upstream, "failed:", err ); rcode = dnsmessage.RCodeServerFailure; continue }
+		cache.put( question, forwarded )
+		return forwarded
+	}
+	return errorResponse( &msg, rcode )
+}
+
+// forward sends a query to an upstream and waits for the response
+func ( f *Forwarder ) forward( network, upstream string, query []byte ) ( response []byte, err error ) {
+	ctx, cancel := context.WithTimeout( context.Background(), 2 * time.Second )
+	defer cancel()
+	conn, err := f.dialer.DialContext( ctx, network, upstream )
+	if err != nil { return }
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline( deadline )
+	if network == "tcp" {
+		if err = writeTcpMessage( conn, query ); err != nil { return }
+		return readTcpMessage( conn )
+	}
+	if _, err = conn.Write( query ); err != nil { return }
+	buf := make( []byte, 65535 )
+	for {
+		n, err := conn.Read( buf )
+		if err != nil { return nil, err }
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] { return buf[:n], nil }							// Skip responses with a mismatching ID
+	}
+}
@@ -3,7 +3,6 @@ package rest
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -15,19 +14,20 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 	
 	"github.com/eventure/hide.client.linux/locations"
-	"github.com/eventure/hide.client.linux/resolvers/doh"
-	"github.com/eventure/hide.client.linux/resolvers/plain"
+	"github.com/eventure/hide.client.linux/resolvers"
 	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const userAgent = "HIDE.ME.LINUX.CLI-0.9.12"
+const inTunnelEndpoint = "10.255.255.250:4321"																// REST endpoint of the connected server, reachable through the tunnel only
 
 var ErrAppUpdateRequired = errors.New( "application update required" )
 var ErrBadPin = errors.New( "bad public key PIN" )
@@ -40,6 +40,7 @@ func ( e ErrHttpStatus ) Error() string { return "bad HTTP status " + strconv.It
 type Config struct {
 	APIVersion				string			`yaml:"-"`										// Current API version is 1.0.0
 	Host					string			`yaml:"host,omitempty"`							// FQDN of the server
+	ExitHost				string			`yaml:"exitHost,omitempty"`						// FQDN of the exit server for multi-hop ( double VPN ) connections, empty for single-hop
 	Port					int				`yaml:"port,omitempty"`							// Port to connect to when issuing REST requests
 	Domain					string			`yaml:"domain,omitempty"`						// Domain ( hide.me )
 	AccessTokenPath			string			`yaml:"accessTokenPath,omitempty"`				// Access-Token path
@@ -54,8 +55,20 @@ type Config struct {
 	Filter					Filter			`yaml:"filter,omitempty"`						// Filtering settings
 	PortForward				PortForward		`yaml:"portForward,omitempty"`					// Enable port-forwarding (uPnP and NAT-PMP)
 	UseDoH					bool			`yaml:"useDoH,omitempty"`						// Use DNS-over-HTTPs resolver
+	UseDnsCrypt				bool			`yaml:"useDnsCrypt,omitempty"`					// Use DNSCrypt resolver when DNS-over-HTTPs fails
+	Resolvers				[]string		`yaml:"resolvers,omitempty"`					// Resolver chain, the names of the resolvers in the order of use
+	Hosts					map[string][]string	`yaml:"hosts,omitempty"`					// Static addresses by host names, used by the "hosts" resolver
+	EndpointCachePath		string			`yaml:"endpointCachePath,omitempty"`			// File which keeps the addresses of successful lookups, used by the "cache" resolver
+	RequireVerification		bool			`yaml:"-"`										// Reject unverified hideservers.net answers of any resolver, copied from the plain resolver's requireVerification ( "--dns-verify" )
+	Pins					Pins			`yaml:"pins,omitempty"`							// Certificate pins of the endpoint classes
+	InTunnelEndpoint		string			`yaml:"inTunnelEndpoint,omitempty"`				// Address and port of the in-tunnel REST endpoint ( filters and port-forwarding ), 10.255.255.250:4321 when empty
+	PublicPort				int				`yaml:"publicPort,omitempty"`					// HTTPS port of api.hide.me, the category list and ipcheck, 443 when 0
+	PublicCA				string			`yaml:"publicCA,omitempty"`						// CA certificate bundle for api.hide.me, the category list and ipcheck ( empty for system-wide CA roots )
 }
 
+func ( c *Config ) inTunnelEndpoint() string { if len( c.InTunnelEndpoint ) > 0 { return c.InTunnelEndpoint }; return inTunnelEndpoint }
+func ( c *Config ) publicPort() int { if c.PublicPort > 0 { return c.PublicPort }; return 443 }
+
 // SetHost adds .hideservers.net suffix for short names ( nl becomes nl.hideservers.net ) or removes .hide.me and replaces it with .hideservers.net.
 func ( c *Config ) SetHost( host string ) {
 	c.Host = host
@@ -68,27 +81,53 @@ type Client struct {
 	*Config
 	
 	client					*http.Client
-	dohResolver				*doh.Resolver
-	plainResolver			*plain.Resolver
+	resolvers				map[string]resolvers.Resolver									// Resolvers by their names
+	dialer					*net.Dialer
+	routeOps				RouteOps														// Routing subsystem interface, throw routes for the Happy Eyeballs candidates
 	remote					*net.TCPAddr													// Remote endpoint as resolved by Resolve
+	remoteHost				string															// Host the remote endpoint belongs to
+	inTunnel				bool															// REST requests travel through an already established tunnel ( multi-hop exit server )
 	
 	accessToken				[]byte
-	authorizedPins			map[string]string
+	pinClass				string															// Endpoint class of the current requests, PinClassVpn unless set otherwise
+	pinSets					map[string]PinSet												// Effective pin sets by endpoint classes
+	pinOverrides			map[string]PinSet												// Pin sets which replace the effective ones
+	matchedPin				*MatchedPin														// Pin matched during the last TLS handshake
+}
+
+func New( config *Config ) *Client {
+	if config == nil { config = &Config{} }
+	c := &Client{ Config: config, resolvers: map[string]resolvers.Resolver{} }
+	c.resolvers[resolvers.Previous] = resolvers.Func( c.previous )
+	return c
+}
+
+// SetResolver adds a resolver to the resolvers the chain may use, resolvers which mark their sockets use the REST client's mark
+func (c *Client) SetResolver( name string, resolver resolvers.Resolver ) {
+	if marker, ok := resolver.( resolvers.Marker ); ok { marker.SetMark( c.Config.Mark ) }
+	c.resolvers[name] = resolver
 }
 
-func New( config *Config ) *Client { if config == nil { config = &Config{} }; return &Client{ Config: config } }
-func (c *Client) SetDohResolver(dohResolver *doh.Resolver) { c.dohResolver = dohResolver; c.dohResolver.SetMark(c.Config.Mark) }
-func (c *Client) SetPlainResolver(plainResolver *plain.Resolver) { c.plainResolver = plainResolver; plainResolver.SetMark(c.Config.Mark) }
+func (c *Client) SetResolvers( named map[string]resolvers.Resolver ) { for name, resolver := range named { c.SetResolver( name, resolver ) } }
+func (c *Client) SetInTunnel(inTunnel bool) { c.inTunnel = inTunnel }
+func (c *Client) SetRouteOps(routeOps RouteOps) { c.routeOps = routeOps }
+
+// SetPins replaces the pin set of an endpoint class regardless of the configuration, e.g. with the pins of a resttest server
+func (c *Client) SetPins( class string, pinSet PinSet ) {
+	if c.pinOverrides == nil { c.pinOverrides = map[string]PinSet{} }
+	c.pinOverrides[class] = pinSet
+}
 
 func ( c *Client ) Init() ( err error ) {
 	if c.Config.Port == 0 { c.Config.Port = 432 }
 	if c.Port == 443 { c.APIVersion = "v1" }
 	if c.Domain != "hide.me" { err = ErrBadDomain; return }
 	
-	dialer := &net.Dialer{}																															// Use a custom dialer to set the socket mark on sockets when those are configured
+	c.dialer = &net.Dialer{}																															// Use a custom dialer to set the socket mark on sockets when those are configured
 	if c.Config.Mark > 0 {
-		dialer.Control = func( network, address string, rawConn syscall.RawConn ) ( err error ) {
-			if network == "tcp4" && address == "10.255.255.250:4321" { return }																		// Do not set marks for in-tunnel traffic
+		c.dialer.Control = func( network, address string, rawConn syscall.RawConn ) ( err error ) {
+			if network == "tcp4" && address == c.Config.inTunnelEndpoint() { return }																		// Do not set marks for in-tunnel traffic
+			if c.inTunnel { return }																													// Multi-hop exit server requests must traverse the entry tunnel
 			_ = rawConn.Control( func( fd uintptr ) {
 				err = syscall.SetsockoptInt( int(fd), unix.SOL_SOCKET, unix.SO_MARK, c.Config.Mark )
 				if err != nil { log.Println( "Dial: [ERR] Set mark failed:", err ) }
@@ -98,7 +137,7 @@ func ( c *Client ) Init() ( err error ) {
 	}
 	
 	transport := &http.Transport{																													// HTTPS client setup
-		DialContext: 			dialer.DialContext,
+		DialContext: 			c.dialer.DialContext,
 		TLSHandshakeTimeout:	time.Second * 5,
 		DisableKeepAlives:		true,
 		ResponseHeaderTimeout:	time.Second * 5,
@@ -131,39 +170,15 @@ func ( c *Client ) Init() ( err error ) {
 	c.Config.Filter.AccessToken = c.accessToken
 	c.Config.PortForward.AccessToken = c.accessToken
 	
-	c.authorizedPins = map[string]string{																											// Certificate names and pins
-		"Hide.Me Root CA": "AdKh8rXi68jeqv5kEzF4wJ9M2R89gFuMILRQ1uwADQI=",
-		"Hide.Me Server CA #1": "CsEyDelMHMPh9qLGgeQn8sJwdUwvc+fCMhOU9Ne5PbU=",
-		"DigiCert Global Root CA": "r/mIkG3eEpVdm+u/ko/cwxzOMo1bk4TyHIlByibiA5E=",
-		"DigiCert TLS RSA SHA256 2020 CA1": "RQeZkB42znUfsDIIFWIRiYEcKl7nHwNFwWCrnMMJbVc=",
-	}
+	if err = c.Config.Pins.check(); err != nil { return }
+	c.pinSets = c.Config.Pins.effective()																											// Pin sets of the pin-set file or of the configuration
+	for class, pinSet := range c.pinOverrides { c.pinSets[class] = pinSet }
+	if len( c.pinClass ) == 0 { c.pinClass = PinClassVpn }
 	return
 }
 
 func ( c *Client ) Remote() *net.TCPAddr { return c.remote }
 
-// Pins checks public key pins of authorized hide.me/hideservers.net CA certificates
-func ( c *Client ) Pins( _ [][]byte, verifiedChains [][]*x509.Certificate) error {
-	if len( c.authorizedPins ) == 0 { return nil }
-	for _, chain := range verifiedChains {
-		chainLoop:
-		for _, certificate := range chain {
-			if !certificate.IsCA { continue }
-			sum := sha256.Sum256( certificate.RawSubjectPublicKeyInfo )
-			pin := base64.StdEncoding.EncodeToString( sum[:] )
-			for name, authorizedPin := range c.authorizedPins {
-				if certificate.Subject.CommonName == name && pin == authorizedPin {
-					log.Println( "Pins:", certificate.Subject.CommonName, "pin OK" )
-					continue chainLoop
-				}
-			}
-			log.Println( "Pins:", certificate.Subject.CommonName, "pin failed" )
-			return ErrBadPin
-		}
-	}
-	return nil
-}
-
 func ( c *Client ) postJson( ctx context.Context, url string, object interface{} ) ( responseBody []byte, err error ) {
 	body, err := json.MarshalIndent( object, "", "\t" )
 	if err != nil { return }
@@ -194,31 +209,33 @@ func ( c *Client ) get( ctx context.Context, url string ) ( body []byte, headers
 
 func ( c *Client ) HaveAccessToken() bool { if c.accessToken != nil { return true }; return false }
 
-// Resolve resolves an IP of a Hide.me endpoint and stores that IP for further use. Hide.me balances DNS rapidly, so once an IP is acquired it needs to be used for the remainder of the session
+// Resolve resolves the IPs of a Hide.me endpoint and stores one of those for further use. Hide.me balances DNS rapidly, so once an IP is acquired it needs to be used for the remainder of the session
+// The resolvers get used in the order of the configured resolver chain. When there are multiple candidates the one which accepts a connection first wins ( Happy Eyeballs )
 func ( c *Client ) Resolve( ctx context.Context ) ( err error ) {
 	if len( c.Config.Host ) == 0 { err = ErrMissingHost; return }
 	if ip := net.ParseIP( c.Config.Host ); ip != nil { c.remote = &net.TCPAddr{ IP: ip, Port: c.Config.Port }; return }								// c.Host is an IP address, set remote endpoint to that IP
 	
-	var ips []net.IP
-	if c.Config.UseDoH && c.dohResolver != nil {
-		if ips, err = c.dohResolver.Resolve( ctx, c.Config.Host ); err == nil && len(ips) > 0 {														// Use DoH response, fall back to plain DNS on error or no results
-			c.remote = &net.TCPAddr{ IP: ips[0], Port: c.Config.Port }																				// ips[0] will be IPv4 on IPv4 only and dual-stack
-			log.Println( "Name: DoH resolved", c.Config.Host, "to", c.remote.IP )
-			return
-		}
+	chain := &resolvers.Chain{ Names: c.Config.Resolvers, Resolvers: c.resolvers, RequireVerified: c.Config.RequireVerification }
+	if len( chain.Names ) == 0 { chain.Names = resolvers.DefaultChain }
+	chain.Names = slices.DeleteFunc( slices.Clone( chain.Names ), func( name string ) bool {														// DoH and DNSCrypt may be switched off
+		return ( name == resolvers.DoH && !c.Config.UseDoH ) || ( name == resolvers.DnsCrypt && !c.Config.UseDnsCrypt )
+	})
+	answer, err := chain.Lookup( ctx, c.Config.Host )
+	if err != nil { log.Println( "Name: Lookup", c.Config.Host, "failed:", err ); return }
+	switch answer.Resolver {
+		case resolvers.Hosts, resolvers.Previous, resolvers.Cache:																						// Not a fresh lookup
+		default: ( &resolvers.EndpointCache{ Filename: c.Config.EndpointCachePath } ).Store( c.Config.Host, answer.IPs, answer.Verified )
 	}
-	
-	if ips, err = c.plainResolver.Resolve( ctx, c.Config.Host ); err == nil && len(ips) > 0 {														// Use DNS response
-		c.remote = &net.TCPAddr{ IP: ips[0], Port: c.Config.Port }
-		log.Println( "Name: DNS resolved", c.Config.Host, "to", c.remote.IP )
-		return
-	}
-	
-	if c.remote != nil { log.Println( "Name: Using previous lookup response", c.remote.String() ); return nil }										// When DoH and plain DNS fail, but there's a record of a previous successful lookup, use that
-	log.Println( "Name: Lookup", c.Config.Host, "failed:", err )
+	c.remote, c.remoteHost = &net.TCPAddr{ IP: c.pick( ctx, answer.IPs ), Port: c.Config.Port }, c.Config.Host
 	return
 }
 
+// previous resolves to the address resolved previously, when there's a record of a previous successful lookup of the same name
+func ( c *Client ) previous( _ context.Context, name string ) ( ips []net.IP, err error ) {
+	if c.remote == nil || c.remoteHost != name { return nil, errors.New( "no previous lookup" ) }
+	return []net.IP{ c.remote.IP }, nil
+}
+
 // Connect issues a connect request to a Hide.me "Connect" endpoint which expects an ordinary POST request with a ConnectRequest JSON payload
 func ( c *Client ) Connect( ctx context.Context, key wgtypes.Key ) ( connectResponse *ConnectResponse, err error ) {
 	if len( c.Config.Host ) == 0 { err = ErrMissingHost; return }
@@ -276,20 +293,26 @@ func ( c *Client ) GetAccessToken( ctx context.Context ) ( accessToken string, e
 
 func ( c *Client ) ApplyFilter( ctx context.Context ) ( err error ) {
 	if err = c.Config.Filter.Check(); err != nil { return }
-	response, err := c.postJson( ctx, "https://10.255.255.250:4321/filter", c.Config.Filter )
+	response, err := c.postJson( ctx, "https://" + c.Config.inTunnelEndpoint() + "/filter", c.Config.Filter )
 	if string(response) == "false" { err = errors.New( "filter failed" ) }
 	return
 }
 
 func ( c *Client ) EnablePortForwarding( ctx context.Context ) ( err error ) {
-	response, err := c.postJson( ctx, "https://10.255.255.250:4321/upnp", c.Config.PortForward )
+	response, err := c.postJson( ctx, "https://" + c.Config.inTunnelEndpoint() + "/upnp", c.Config.PortForward )
 	if string(response) == "false" { err = errors.New( "port-forwarding failed" ) }
 	return
 }
 
-func ( c *Client ) FetchCategoryList( ctx context.Context ) ( err error ) {
-	c.Config.Port = 443
-	c.Config.CA = ""
+// Category is a filtering category, see Filter.Categories
+type Category struct {
+	Name		string
+	Description	string
+}
+
+// FetchCategoryList fetches the filtering categories from the server
+func ( c *Client ) FetchCategoryList( ctx context.Context ) ( categories []Category, err error ) {
+	c.Config.Port, c.Config.CA = c.Config.publicPort(), c.Config.PublicCA
 	
 	if err = c.Init(); err != nil { log.Println( "Cats: [ERR] REST Client setup failed:", err ); return }
 	c.client.Transport.(*http.Transport).Protocols.SetHTTP1( true )
@@ -297,28 +320,17 @@ func ( c *Client ) FetchCategoryList( ctx context.Context ) ( err error ) {
 
 	response, _, err := c.get( ctx, "https://" + c.remote.String() + "/categorization/categories.json" )
 	if err != nil { return }
-	
-	type Category struct {
-		Name		string
-		Description	string
-	}
-	cats := []Category{}
-	if err = json.Unmarshal( response, &cats ); err != nil { return }
-	
-	log.Printf( "%40s | %s\n", "CATEGORY", "DESCRIPTION" )
-	log.Printf( "%40s | %s\n", "--------", "-----------" )
-	for _, cat := range cats { log.Printf( "%40s | %s\n", cat.Name, cat.Description ) }
+	err = json.Unmarshal( response, &categories )
 	return
 }
 
-// FetchServerList fetches the server list from api.hide.me. It has to use system-wide CA store, has to relax PIN checks, use api.hide.me SAN and may use HTTP2
+// FetchServerList fetches the server list from api.hide.me. It has to use system-wide CA store ( unless PublicCA is set ), has to relax PIN checks, use api.hide.me SAN and may use HTTP2
 func ( c *Client ) FetchServerList( ctx context.Context ) ( response []byte, headers http.Header, err error ) {
-	c.Config.Port = 443
-	c.Config.CA = ""
+	c.Config.Port, c.Config.CA = c.Config.publicPort(), c.Config.PublicCA
 	c.Config.Host = "api.hide.me"
 	
+	c.pinClass = PinClassApi
 	if err = c.Init(); err != nil { log.Println( "SeLi: [ERR] REST Client setup failed:", err ); return }
-	c.authorizedPins = nil
 	c.client.Transport.(*http.Transport).TLSClientConfig.ServerName = "api.hide.me"
 	
 	if err = c.Resolve( ctx ); err != nil { log.Println( "SeLi: [ERR] DNS failed:", err ); return }
@@ -361,13 +373,17 @@ func ( c *Client ) PrintServerList( ctx context.Context, kind string ) ( err err
 	return
 }
 
-// ExternalIps fetches external Ips from ipcheck(-v6).hideservers.net
+// ExternalIps fetches external Ips from ipcheck(-v6).hideservers.net. Plain HTTP is used unless ipCheck pins are configured
 func ( c *Client ) ExternalIps( ctx context.Context, routeFn func( bool, net.IP ) error, ipv4Func, ipv6Func func( ip net.IP ) ) ( err error ) {
-	c.Config.Port, c.Config.CA = 80, ""
+	c.Config.Port, c.Config.CA, c.pinClass = 80, "", PinClassIpCheck
 	var buf []byte
 	
 	if err = c.Init(); err != nil { log.Println( "ExIp: [ERR] REST Client setup failed:", err ); return }
-	c.authorizedPins = nil
+	scheme := "http://"
+	if !c.pinSets[PinClassIpCheck].Empty() {																										// Pins are of no use without TLS
+		scheme, c.Config.Port, c.Config.CA = "https://", c.Config.publicPort(), c.Config.PublicCA
+		if err = c.Init(); err != nil { log.Println( "ExIp: [ERR] REST Client setup failed:", err ); return }
+	}
 	c.client.Transport.(*http.Transport).Protocols.SetHTTP1( true )
 	c.client.Transport.(*http.Transport).Protocols.SetHTTP2( true )
 	
@@ -375,9 +391,9 @@ func ( c *Client ) ExternalIps( ctx context.Context, routeFn func( bool, net.IP
 		c.Config.Host, c.client.Transport.(*http.Transport).TLSClientConfig.ServerName = name, name
 		if err = c.Resolve( ctx ); err != nil { log.Println( "ExIp: [ERR] DNS failed:", err ); return }
 		if err = routeFn( true, c.Remote().IP ); err != nil { log.Println( "ExIp: [ERR] Route", c.Remote().IP, "failed:", err ); return }
-		buf, _, err = c.get( ctx, "http://" + c.remote.String() )
+		buf, _, err = c.get( ctx, scheme + c.remote.String() )
 		_ = routeFn( false, c.Remote().IP )
-		if err != nil { log.Println( "ExIp: [ERR] Get http://" + c.Config.Host + " failed" ); return }
+		if err != nil { log.Println( "ExIp: [ERR] Get " + scheme + c.Config.Host + " failed" ); return }
 		callback( net.ParseIP( string(buf) ) )
 		return
 	}
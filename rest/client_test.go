@@ -0,0 +1,217 @@
+package rest_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/eventure/hide.client.linux/locations"
+	"github.com/eventure/hide.client.linux/rest"
+	"github.com/eventure/hide.client.linux/rest/resttest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	testHost = "nl.hideservers.net"
+	testUsername = "username"
+	testPassword = "password"
+)
+
+func newServer( t *testing.T ) *resttest.Server {
+	t.Helper()
+	s, err := resttest.New( testUsername, testPassword )
+	if err != nil { t.Fatal( err ) }
+	t.Cleanup( s.Close )
+	return s
+}
+
+func testContext( t *testing.T ) context.Context {
+	ctx, cancel := context.WithTimeout( context.Background(), 10 * time.Second )
+	t.Cleanup( cancel )
+	return ctx
+}
+
+// newClient returns a resolved REST client of the fake server which holds an Access-Token issued for the credentials
+func newClient( t *testing.T, s *resttest.Server ) *rest.Client {
+	t.Helper()
+	client, err := s.Client( testHost )
+	if err != nil { t.Fatal( err ) }
+	if err = client.Resolve( testContext( t ) ); err != nil { t.Fatal( err ) }
+	client.Config.Username, client.Config.Password = testUsername, testPassword
+	if _, err = client.GetAccessToken( testContext( t ) ); err != nil { t.Fatal( err ) }
+	client.Config.Username, client.Config.Password = "", ""
+	return client
+}
+
+func connect( t *testing.T, client *rest.Client ) *rest.ConnectResponse {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil { t.Fatal( err ) }
+	response, err := client.Connect( testContext( t ), key.PublicKey() )
+	if err != nil { t.Fatal( err ) }
+	return response
+}
+
+func TestConnectDisconnect( t *testing.T ) {
+	s := newServer( t )
+	client := newClient( t, s )
+	response := connect( t, client )
+	serverKey := s.ServerPublicKey()
+	if !slices.Equal( response.PublicKey, serverKey[:] ) { t.Fatal( "server public key mismatch" ) }
+	if len( response.SessionToken ) == 0 || response.StaleAccessToken { t.Fatal( "bad connect response" ) }
+	if s.Sessions() != 1 { t.Fatal( "session not established" ) }
+	if pin := client.MatchedPin(); pin == nil || pin.Class != rest.PinClassVpn || pin.Backup || pin.Subject != resttest.IntermediateName { t.Fatalf( "matched pin %+v", pin ) }
+
+	if err := client.Disconnect( testContext( t ), response.SessionToken ); err != nil { t.Fatal( err ) }
+	if s.Sessions() != 0 { t.Fatal( "session not closed" ) }
+	if err := client.Disconnect( testContext( t ), response.SessionToken ); err == nil { t.Fatal( "unknown session disconnected" ) }
+}
+
+func TestAccessTokenRefresh( t *testing.T ) {
+	s := newServer( t )
+	client := newClient( t, s )
+	client.Config.AccessTokenPath = filepath.Join( t.TempDir(), "accessToken.txt" )
+
+	accessToken, err := client.GetAccessToken( testContext( t ) )													// Refresh through the Access-Token, no credentials
+	if err != nil { t.Fatal( err ) }
+	stored, err := os.ReadFile( client.Config.AccessTokenPath )
+	if err != nil || string( stored ) != accessToken { t.Fatal( "refreshed Access-Token not stored:", err ) }
+	connect( t, client )
+	if s.Requests( resttest.AccessTokenPath ) != 2 { t.Fatal( "unexpected number of Access-Token requests" ) }
+
+	unknown, err := s.Client( testHost )																		// An Access-Token the server has not issued gets rejected
+	if err != nil { t.Fatal( err ) }
+	unknown.Config.AccessToken = base64.StdEncoding.EncodeToString( make( []byte, 32 ) )
+	if err = unknown.Init(); err != nil { t.Fatal( err ) }
+	if err = unknown.Resolve( testContext( t ) ); err != nil { t.Fatal( err ) }
+	if _, err = unknown.GetAccessToken( testContext( t ) ); !isStatus( err, http.StatusUnauthorized ) { t.Fatal( "unknown Access-Token accepted:", err ) }
+	s.AddAccessToken( make( []byte, 32 ) )																		// Once the server knows it, the same Access-Token gets refreshed
+	if _, err = unknown.GetAccessToken( testContext( t ) ); err != nil { t.Fatal( "known Access-Token rejected:", err ) }
+}
+
+func TestStaleAccessToken( t *testing.T ) {
+	s := newServer( t )
+	client := newClient( t, s )
+	s.SetStaleAccessToken( true )
+	if response := connect( t, client ); !response.StaleAccessToken { t.Fatal( "stale Access-Token flag not set" ) }
+	s.SetStaleAccessToken( false )
+	if response := connect( t, client ); response.StaleAccessToken { t.Fatal( "stale Access-Token flag set" ) }
+}
+
+func TestApplyFilter( t *testing.T ) {
+	s := newServer( t )
+	client := newClient( t, s )
+	client.Config.Filter = rest.Filter{ Ads: true, Malware: true, PG: 12, Blacklist: []string{ "example.com" } }
+	if err := client.ApplyFilter( testContext( t ) ); err != nil { t.Fatal( err ) }
+	filter := s.LastFilter()
+	if filter == nil || !filter.Ads || !filter.Malware || filter.PG != 12 || !slices.Equal( filter.Blacklist, []string{ "example.com" } ) { t.Fatalf( "filter %+v", filter ) }
+
+	s.SetFault( resttest.FilterPath, resttest.Fault{ Body: "false" } )
+	if err := client.ApplyFilter( testContext( t ) ); err == nil { t.Fatal( "rejected filter reported as applied" ) }
+
+	client.Config.Filter.PG = 13																				// Bad filters don't get posted
+	if err := client.ApplyFilter( testContext( t ) ); err == nil || s.Requests( resttest.FilterPath ) != 2 { t.Fatal( "bad filter posted:", err ) }
+}
+
+func TestEnablePortForwarding( t *testing.T ) {
+	s := newServer( t )
+	client := newClient( t, s )
+	client.Config.PortForward.Enabled = true
+	if err := client.EnablePortForwarding( testContext( t ) ); err != nil { t.Fatal( err ) }
+	if s.Requests( resttest.PortForwardPath ) != 1 { t.Fatal( "port-forwarding not requested" ) }
+	s.SetFault( resttest.PortForwardPath, resttest.Fault{ Body: "false" } )
+	if err := client.EnablePortForwarding( testContext( t ) ); err == nil { t.Fatal( "failed port-forwarding reported as enabled" ) }
+}
+
+func TestFetchServerList( t *testing.T ) {
+	s := newServer( t )
+	serverList := []locations.Location{ { Id: 7, Hostname: "de.hideservers.net", Flag: "de", DisplayName: "Germany" } }
+	s.SetServerList( serverList )
+	client, err := s.Client( testHost )
+	if err != nil { t.Fatal( err ) }
+	response, _, err := client.FetchServerList( testContext( t ) )
+	if err != nil { t.Fatal( err ) }
+	fetched := []locations.Location{}
+	if err = json.Unmarshal( response, &fetched ); err != nil { t.Fatal( err ) }
+	if len( fetched ) != 1 || fetched[0].Hostname != "de.hideservers.net" { t.Fatalf( "server list %+v", fetched ) }
+	if pin := client.MatchedPin(); pin == nil || pin.Class != rest.PinClassApi { t.Fatalf( "matched pin %+v", pin ) }
+}
+
+func TestFetchCategoryList( t *testing.T ) {
+	s := newServer( t )
+	s.SetCategories( []resttest.Category{ { Name: "gambling", Description: "Gambling sites" } } )
+	client, err := s.Client( testHost )
+	if err != nil { t.Fatal( err ) }
+	categories, err := client.FetchCategoryList( testContext( t ) )
+	if err != nil { t.Fatal( err ) }
+	if len( categories ) != 1 || categories[0].Name != "gambling" || categories[0].Description != "Gambling sites" { t.Fatalf( "categories %+v", categories ) }
+	if s.Requests( resttest.CategoriesPath ) != 1 { t.Fatal( "unexpected number of category list requests" ) }
+}
+
+func TestExternalIps( t *testing.T ) {
+	s := newServer( t )
+	client, err := s.Client( testHost )																			// ipCheck pins are set, so HTTPS gets used
+	if err != nil { t.Fatal( err ) }
+	routed, ipv4, ipv6 := 0, net.IP( nil ), net.IP( nil )
+	err = client.ExternalIps( testContext( t ), func( route bool, _ net.IP ) error { if route { routed++ } else { routed-- }; return nil },
+		func( ip net.IP ) { ipv4 = ip }, func( ip net.IP ) { ipv6 = ip } )
+	if err != nil { t.Fatal( err ) }
+	if !ipv4.IsLoopback() || !ipv6.IsLoopback() { t.Fatal( "external IPs", ipv4, ipv6 ) }
+	if routed != 0 { t.Fatal( "throw routes left behind" ) }
+	if s.Requests( resttest.IpCheckPath ) != 2 { t.Fatal( "unexpected number of ipcheck requests" ) }
+	if pin := client.MatchedPin(); pin == nil || pin.Class != rest.PinClassIpCheck { t.Fatalf( "matched pin %+v", pin ) }
+}
+
+func TestFaults( t *testing.T ) {
+	s := newServer( t )
+	client := newClient( t, s )
+
+	s.SetFault( resttest.ConnectPath, resttest.Fault{ Status: http.StatusInternalServerError } )
+	key, _ := wgtypes.GeneratePrivateKey()
+	if _, err := client.Connect( testContext( t ), key.PublicKey() ); !isStatus( err, http.StatusInternalServerError ) { t.Fatal( "got", err ) }
+	if s.Sessions() != 0 { t.Fatal( "session established despite the fault" ) }
+
+	s.SetFault( resttest.ConnectPath, resttest.Fault{ Delay: 5 * time.Second } )									// The delay outlasts the REST timeout
+	client.Config.RestTimeout = 200 * time.Millisecond
+	if err := client.Init(); err != nil { t.Fatal( err ) }
+	start := time.Now()
+	if _, err := client.Connect( testContext( t ), key.PublicKey() ); err == nil { t.Fatal( "delayed response accepted" ) }
+	if elapsed := time.Since( start ); elapsed > 2 * time.Second { t.Fatal( "REST timeout not applied, the request took", elapsed ) }
+
+	s.SetFault( resttest.ConnectPath, resttest.Fault{} )
+	client.Config.RestTimeout = 10 * time.Second
+	if err := client.Init(); err != nil { t.Fatal( err ) }
+	connect( t, client )
+}
+
+func TestPins( t *testing.T ) {
+	s := newServer( t )
+	other := sha256.Sum256( []byte( "other key" ) )
+	otherPin := base64.StdEncoding.EncodeToString( other[:] )
+
+	client := newClient( t, s )																					// Primary pins mismatch, the backup pin matches
+	client.SetPins( rest.PinClassVpn, rest.PinSet{ Primary: []string{ otherPin }, Backup: s.Pins().Backup } )
+	if err := client.Init(); err != nil { t.Fatal( err ) }
+	connect( t, client )
+	if pin := client.MatchedPin(); pin == nil || !pin.Backup || pin.Subject != resttest.RootName { t.Fatalf( "matched pin %+v", pin ) }
+
+	client.SetPins( rest.PinClassVpn, rest.PinSet{ Primary: []string{ otherPin } } )							// No pin matches
+	if err := client.Init(); err != nil { t.Fatal( err ) }
+	key, _ := wgtypes.GeneratePrivateKey()
+	if _, err := client.Connect( testContext( t ), key.PublicKey() ); !errors.Is( err, rest.ErrBadPin ) { t.Fatal( "pin mismatch not detected:", err ) }
+	if s.Requests( resttest.ConnectPath ) != 1 { t.Fatal( "request sent despite the pin mismatch" ) }
+}
+
+func isStatus( err error, status int ) bool {
+	statusErr := rest.ErrHttpStatus( 0 )
+	return errors.As( err, &statusErr ) && int( statusErr ) == status
+}
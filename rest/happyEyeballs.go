@@ -0,0 +1,86 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const connectionAttemptDelay = 250 * time.Millisecond																								// RFC 8305 recommended delay between connection attempts
+
+type RouteOps interface {
+	ThrowRouteAdd( logPrefix string, dst *net.IPNet ) ( err error )
+	ThrowRouteDel( logPrefix string, dst *net.IPNet ) ( err error )
+}
+
+// interleave orders the candidate addresses by alternating between the families, IPv6 first ( RFC 8305, section 4 )
+func interleave( ips []net.IP ) ( ordered []net.IP ) {
+	var ipv4, ipv6 []net.IP
+	for _, ip := range ips { if ip.To4() != nil { ipv4 = append( ipv4, ip ) } else { ipv6 = append( ipv6, ip ) } }
+	for i := 0; i < max( len( ipv4 ), len( ipv6 ) ); i++ {
+		if i < len( ipv6 ) { ordered = append( ordered, ipv6[i] ) }
+		if i < len( ipv4 ) { ordered = append( ordered, ipv4[i] ) }
+	}
+	return
+}
+
+// happyEyeballs races TCP connection attempts to the candidate addresses. A new attempt starts every connectionAttemptDelay, or right away when the previous one fails. The address which connects first wins
+func ( c *Client ) happyEyeballs( ctx context.Context, ips []net.IP ) ( winner net.IP, err error ) {
+	candidates := interleave( ips )
+	if c.routeOps != nil && c.Config.Mark == 0 {																									// Throw routes are required when leak protection is active and marks are not being used
+		for _, ip := range candidates {
+			hostNet := ipNet( ip )
+			if err = c.routeOps.ThrowRouteAdd( "REST candidate", hostNet ); err != nil { return }
+			defer c.routeOps.ThrowRouteDel( "REST candidate", hostNet )
+		}
+	}
+	
+	ctx, cancel := context.WithCancel( ctx )
+	defer cancel()																																	// Cancel the attempts still in progress once there's a winner
+	type result struct {
+		ip		net.IP
+		err		error
+	}
+	results := make( chan result, len( candidates ) )
+	attempt := func( ip net.IP ) {
+		conn, dialErr := c.dialer.DialContext( ctx, "tcp", net.JoinHostPort( ip.String(), strconv.Itoa( c.Config.Port ) ) )
+		if dialErr == nil { _ = conn.Close() }
+		results <- result{ ip, dialErr }
+	}
+	
+	timer := time.NewTimer( 0 )
+	defer timer.Stop()
+	for started, failed := 0, 0; ; {
+		select {
+			case <-timer.C:
+				if started == len( candidates ) { break }
+				go attempt( candidates[started] )
+				started++
+				timer.Reset( connectionAttemptDelay )
+			case r := <-results:
+				if r.err == nil { log.Println( "HaEy: Connected to", r.ip, "first" ); return r.ip, nil }
+				log.Println( "HaEy: [WARN] Connection to", r.ip, "failed:", r.err )
+				if failed++; failed == len( candidates ) { return nil, errors.New( "no candidate address is reachable" ) }
+				if started < len( candidates ) { timer.Reset( 0 ) }																				// Start the next attempt right away
+			case <-ctx.Done():
+				return nil, ctx.Err()
+		}
+	}
+}
+
+// pick chooses the remote address out of the resolved ones. In-tunnel requests must not probe the candidates outside the tunnel, so the first address gets used for those
+func ( c *Client ) pick( ctx context.Context, ips []net.IP ) net.IP {
+	if len( ips ) == 1 || c.inTunnel { return ips[0] }
+	winner, err := c.happyEyeballs( ctx, ips )
+	if err != nil { log.Println( "HaEy: [ERR] Racing", ips, "failed:", err ); return ips[0] }
+	return winner
+}
+
+// ipNet returns a host network of ip
+func ipNet( ip net.IP ) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil { return &net.IPNet{ IP: ip4, Mask: net.CIDRMask( 32, 32 ) } }
+	return &net.IPNet{ IP: ip, Mask: net.CIDRMask( 128, 128 ) }
+}
@@ -0,0 +1,165 @@
+package rest
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	
+	"github.com/eventure/hide.client.linux/atomicfile"
+	"github.com/eventure/hide.client.linux/minisign"
+)
+
+const (																										// Endpoint classes, each one has its own pin set
+	PinClassVpn = "vpn"																						// REST endpoints of the VPN servers
+	PinClassApi = "api"																						// api.hide.me
+	PinClassIpCheck = "ipCheck"																				// ipcheck(-v6).hideservers.net
+)
+
+// DefaultVpnPins are the pins of the CAs which issue the certificates of the VPN server REST endpoints
+var DefaultVpnPins = PinSet{
+	Primary: []string{
+		"AdKh8rXi68jeqv5kEzF4wJ9M2R89gFuMILRQ1uwADQI=",														// Hide.Me Root CA
+		"CsEyDelMHMPh9qLGgeQn8sJwdUwvc+fCMhOU9Ne5PbU=",														// Hide.Me Server CA #1
+		"r/mIkG3eEpVdm+u/ko/cwxzOMo1bk4TyHIlByibiA5E=",														// DigiCert Global Root CA
+		"RQeZkB42znUfsDIIFWIRiYEcKl7nHwNFwWCrnMMJbVc=",														// DigiCert TLS RSA SHA256 2020 CA1
+	},
+}
+
+// PinSet lists base64 encoded SHA256 hashes of certificate SubjectPublicKeyInfo structures. A certificate chain is accepted when any of its certificates matches, an empty set disables pinning
+type PinSet struct {
+	Primary		[]string	`yaml:"primary,omitempty" json:"primary,omitempty"`
+	Backup		[]string	`yaml:"backup,omitempty" json:"backup,omitempty"`								// Pins of the keys the servers may rotate to
+}
+
+func ( s PinSet ) Empty() bool { return len( s.Primary ) == 0 && len( s.Backup ) == 0 }
+
+func ( s PinSet ) check() ( err error ) {
+	for _, pin := range append( slices.Clone( s.Primary ), s.Backup... ) {
+		if hash, decodeErr := base64.StdEncoding.DecodeString( pin ); decodeErr != nil || len( hash ) != sha256.Size { return errors.New( "bad pin " + pin ) }
+	}
+	return
+}
+
+// Pins configures the pin sets of the endpoint classes. A pin-set file signed by Key, when present, takes precedence over the configured pin sets
+type Pins struct {
+	Vpn			PinSet		`yaml:"vpn,omitempty" json:"vpn,omitempty"`
+	Api			PinSet		`yaml:"api,omitempty" json:"api,omitempty"`
+	IpCheck		PinSet		`yaml:"ipCheck,omitempty" json:"ipCheck,omitempty"`
+	File		string		`yaml:"file,omitempty" json:"file,omitempty"`							// Pin-set file ( JSON, the same layout as the vpn, api and ipCheck attributes ), its minisign signature is expected in File + ".minisig"
+	Key			string		`yaml:"key,omitempty" json:"key,omitempty"`								// Minisign public key the pin-set file is signed with
+	UpdateURL	string		`yaml:"updateURL,omitempty" json:"updateURL,omitempty"`					// URL the "pins update" command downloads the pin-set file from, the signature is expected at UpdateURL + ".minisig"
+}
+
+// MatchedPin describes the pin which a server's certificate chain matched
+type MatchedPin struct {
+	Class		string		`json:"class"`
+	Pin			string		`json:"pin"`
+	Backup		bool		`json:"backup,omitempty"`
+	Subject		string		`json:"subject"`															// Common name of the matching certificate
+}
+
+// Pin returns the pin of a certificate, the base64 encoded SHA256 hash of its SubjectPublicKeyInfo
+func Pin( certificate *x509.Certificate ) string {
+	sum := sha256.Sum256( certificate.RawSubjectPublicKeyInfo )
+	return base64.StdEncoding.EncodeToString( sum[:] )
+}
+
+func ( p *Pins ) sets() map[string]PinSet { return map[string]PinSet{ PinClassVpn: p.Vpn, PinClassApi: p.Api, PinClassIpCheck: p.IpCheck } }
+
+func ( p *Pins ) check() ( err error ) {
+	for class, set := range p.sets() { if err = set.check(); err != nil { return errors.New( class + ": " + err.Error() ) } }
+	return
+}
+
+// parsePinFile verifies the signature of pin-set file content and parses it
+func ( p *Pins ) parsePinFile( content, signature []byte ) ( file *Pins, err error ) {
+	if len( p.Key ) == 0 { return nil, errors.New( "no pin-set file key configured" ) }
+	key, err := minisign.ParseKey( p.Key )
+	if err != nil { return }
+	if err = key.Verify( content, signature ); err != nil { return }
+	file = &Pins{}
+	if err = json.Unmarshal( content, file ); err != nil { return nil, err }
+	if err = file.check(); err != nil { return nil, err }
+	return
+}
+
+// effective returns the pin sets by endpoint classes. The classes listed in a valid pin-set file use the pin sets of the file, the other classes use the configured ones
+func ( p *Pins ) effective() ( sets map[string]PinSet ) {
+	sets = p.sets()
+	if len( p.File ) == 0 { return }
+	content, err := os.ReadFile( p.File )
+	if errors.Is( err, os.ErrNotExist ) { return }
+	signature, sigErr := os.ReadFile( p.File + ".minisig" )
+	if err == nil { err = sigErr }
+	file := (*Pins)(nil)
+	if err == nil { file, err = p.parsePinFile( content, signature ) }
+	if err != nil { log.Println( "Pins: [ERR] Pin-set file", p.File, "ignored:", err ); return }
+	for class, set := range file.sets() { if !set.Empty() { sets[class] = set } }
+	return
+}
+
+// UpdatePinFile downloads the pin-set file and its signature from Pins.UpdateURL through the client's transport, verifies them and replaces Pins.File and its signature
+func ( c *Client ) UpdatePinFile( ctx context.Context ) ( err error ) {
+	p := &c.Config.Pins
+	if len( p.UpdateURL ) == 0 || len( p.File ) == 0 { return errors.New( "pin-set file update URL or filename not configured" ) }
+	updateURL, err := url.Parse( p.UpdateURL )
+	if err != nil { return }
+	c.Config.CA = ""																							// The update URL is served with a publicly trusted certificate
+	if err = c.Init(); err != nil { log.Println( "Pins: [ERR] REST Client setup failed:", err ); return }
+	c.client.Transport.(*http.Transport).TLSClientConfig.ServerName = updateURL.Hostname()
+	c.client.Transport.(*http.Transport).TLSClientConfig.VerifyPeerCertificate = nil							// The pin-set file is signed, stale pins must not prevent their own update
+	c.client.Transport.(*http.Transport).Protocols.SetHTTP1( true )
+	content, _, err := c.get( ctx, p.UpdateURL )
+	if err != nil { log.Println( "Pins: [ERR] Download of", p.UpdateURL, "failed:", err ); return }
+	signature, _, err := c.get( ctx, p.UpdateURL + ".minisig" )
+	if err != nil { log.Println( "Pins: [ERR] Download of", p.UpdateURL + ".minisig", "failed:", err ); return }
+	if _, err = p.parsePinFile( content, signature ); err != nil { log.Println( "Pins: [ERR] Pin-set file from", p.UpdateURL, "rejected:", err ); return }
+	if err = atomicfile.Write( p.File + ".minisig", signature ); err == nil { err = atomicfile.Write( p.File, content ) }
+	if err != nil { log.Println( "Pins: [ERR] Write", p.File, "failed:", err ); return }
+	log.Println( "Pins: Pin-set file", p.File, "updated from", p.UpdateURL )
+	return
+}
+
+// Print logs the effective pin sets
+func ( p *Pins ) Print() {
+	sets := p.effective()
+	for _, class := range []string{ PinClassVpn, PinClassApi, PinClassIpCheck } {
+		if sets[class].Empty() { log.Println( "Pins:", class, "pinning disabled" ); continue }
+		for _, pin := range sets[class].Primary { log.Println( "Pins:", class, "primary", pin ) }
+		for _, pin := range sets[class].Backup { log.Println( "Pins:", class, "backup", pin ) }
+	}
+}
+
+// Pins checks the certificate chains against the pin set of the current endpoint class. Primary pins are preferred over backup pins
+func ( c *Client ) Pins( _ [][]byte, verifiedChains [][]*x509.Certificate ) error {
+	set := c.pinSets[c.pinClass]
+	if set.Empty() { log.Println( "Pins: [WARN]", c.Config.Host, "not pinned, the", c.pinClass, "pin set is empty" ); return nil }
+	for _, backup := range []bool{ false, true } {
+		pins := set.Primary
+		if backup { pins = set.Backup }
+		for _, chain := range verifiedChains {
+			for _, certificate := range chain {
+				pin := Pin( certificate )
+				if !slices.Contains( pins, pin ) { continue }
+				c.matchedPin = &MatchedPin{ Class: c.pinClass, Pin: pin, Backup: backup, Subject: certificate.Subject.CommonName }
+				switch backup {
+					case false:	log.Println( "Pins:", certificate.Subject.CommonName, "matched", c.pinClass, "pin", pin )
+					default:	log.Println( "Pins: [WARN]", certificate.Subject.CommonName, "matched", c.pinClass, "backup pin", pin, "( the keys have been rotated, the primary pins need an update )" )
+				}
+				return nil
+			}
+		}
+	}
+	log.Println( "Pins: [ERR] No certificate of", c.Config.Host, "matched the", c.pinClass, "pins" )
+	return ErrBadPin
+}
+
+func ( c *Client ) MatchedPin() *MatchedPin { return c.matchedPin }
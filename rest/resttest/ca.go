@@ -0,0 +1,73 @@
+package resttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+)
+
+const (
+	RootName = "Hide.Me Root CA"																		// Common names of the generated CA certificates, the same as the ones of the real hide.me CAs
+	IntermediateName = "Hide.Me Server CA #1"
+)
+
+// authority is a generated CA hierarchy, a root and an intermediate CA which signs the server certificate
+type authority struct {
+	root			*x509.Certificate
+	intermediate	*x509.Certificate
+	certificate		tls.Certificate																		// Server certificate along with the intermediate CA certificate
+}
+
+func serial() ( *big.Int, error ) { return rand.Int( rand.Reader, new( big.Int ).Lsh( big.NewInt( 1 ), 127 ) ) }
+
+// issue creates a certificate signed by parent ( self-signed when parent is nil )
+func issue( template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey ) ( certificate *x509.Certificate, key *ecdsa.PrivateKey, err error ) {
+	if key, err = ecdsa.GenerateKey( elliptic.P256(), rand.Reader ); err != nil { return }
+	if template.SerialNumber, err = serial(); err != nil { return }
+	template.NotBefore, template.NotAfter = time.Now().Add( -time.Hour ), time.Now().Add( time.Hour * 24 )
+	if parent == nil { parent, parentKey = template, key }
+	der, err := x509.CreateCertificate( rand.Reader, template, parent, &key.PublicKey, parentKey )
+	if err != nil { return }
+	certificate, err = x509.ParseCertificate( der )
+	return
+}
+
+// newAuthority generates the CA hierarchy and a server certificate valid for the hideservers.net names, api.hide.me and the loopback addresses
+func newAuthority() ( a *authority, err error ) {
+	a = &authority{}
+	caTemplate := func( name string, pathLen int ) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:				pkix.Name{ CommonName: name, Organization: []string{ "resttest" } },
+			KeyUsage:				x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid:	true,
+			IsCA:					true,
+			MaxPathLen:				pathLen,
+			MaxPathLenZero:			pathLen == 0,
+		}
+	}
+	root, rootKey, err := issue( caTemplate( RootName, 1 ), nil, nil )
+	if err != nil { return }
+	intermediate, intermediateKey, err := issue( caTemplate( IntermediateName, 0 ), root, rootKey )
+	if err != nil { return }
+	leaf, leafKey, err := issue( &x509.Certificate{
+		Subject:		pkix.Name{ CommonName: "hideservers.net" },
+		DNSNames:		[]string{ "hideservers.net", "*.hideservers.net", "api.hide.me" },
+		IPAddresses:	[]net.IP{ net.IPv4( 127, 0, 0, 1 ), net.IPv6loopback },
+		KeyUsage:		x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:	[]x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth },
+	}, intermediate, intermediateKey )
+	if err != nil { return }
+	a.root, a.intermediate = root, intermediate
+	a.certificate = tls.Certificate{ Certificate: [][]byte{ leaf.Raw, intermediate.Raw }, PrivateKey: leafKey, Leaf: leaf }
+	return
+}
+
+// rootPem returns the root CA certificate in the PEM format, the format of the rest.Config CA bundle
+func ( a *authority ) rootPem() []byte { return pem.EncodeToMemory( &pem.Block{ Type: "CERTIFICATE", Bytes: a.root.Raw } ) }
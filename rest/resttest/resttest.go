@@ -0,0 +1,277 @@
+// Package resttest provides a fake hide.me REST server for exercising rest.Client without real servers.
+// The server uses a generated CA hierarchy named like the hide.me one, Pins() and CAFile() make rest.Client trust it
+package resttest
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+	
+	"github.com/eventure/hide.client.linux/locations"
+	"github.com/eventure/hide.client.linux/resolvers"
+	"github.com/eventure/hide.client.linux/rest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (																									// Paths of the endpoints, the VPN server endpoints are served under both API versions ( "v1.0.0" and "v1" )
+	ConnectPath = "/connect"
+	DisconnectPath = "/disconnect"
+	AccessTokenPath = "/accessToken"
+	FilterPath = "/filter"
+	PortForwardPath = "/upnp"
+	CategoriesPath = "/categorization/categories.json"
+	ServerListPath = "/v1/network/free/en"
+	IpCheckPath = "/"																					// ipcheck(-v6).hideservers.net, responds with the address of the client
+)
+
+// Fault alters the response of an endpoint
+type Fault struct {
+	Status		int																						// HTTP status code returned instead of the regular response, 0 for none
+	Delay		time.Duration																			// Delay before responding, requests canceled meanwhile get no response
+	Body		string																					// Response body returned instead of the regular one, e.g. "false" for the filter endpoint
+}
+
+type Category struct {
+	Name		string
+	Description	string
+}
+
+// Server is a fake hide.me REST server
+type Server struct {
+	*httptest.Server
+	sync.Mutex
+	authority			*authority
+	caFile				string
+	
+	username			string
+	password			string
+	accessTokens		map[string]bool																	// Issued Access-Tokens, base64 encoded
+	sessions			map[string]bool																	// Session-Tokens of the connected sessions, base64 encoded
+	staleAccessToken	bool
+	faults				map[string]Fault																// Faults by endpoint paths ( without the API version )
+	requests			map[string]int																	// Number of requests by endpoint paths ( without the API version )
+	lastFilter			*rest.Filter
+	categories			[]Category
+	serverList			[]locations.Location
+	serverKey			wgtypes.Key
+}
+
+// New starts a fake server which accepts the given credentials, Close stops it
+func New( username, password string ) ( s *Server, err error ) {
+	s = &Server{
+		username:		username,
+		password:		password,
+		accessTokens:	map[string]bool{},
+		sessions:		map[string]bool{},
+		faults:			map[string]Fault{},
+		requests:		map[string]int{},
+		categories:		[]Category{ { Name: "ads", Description: "Advertising" }, { Name: "malware", Description: "Malicious software" } },
+		serverList:		[]locations.Location{ { Id: 1, Hostname: "nl-v4.hideservers.net", Flag: "nl", DisplayName: "Netherlands", Tags: []string{ "free" } } },
+	}
+	if s.authority, err = newAuthority(); err != nil { return nil, err }
+	if s.serverKey, err = wgtypes.GeneratePrivateKey(); err != nil { return nil, err }
+	caFile, err := os.CreateTemp( "", "resttest-ca-*.pem" )
+	if err != nil { return nil, err }
+	s.caFile = caFile.Name()
+	_, err = caFile.Write( s.authority.rootPem() )
+	if closeErr := caFile.Close(); err == nil { err = closeErr }
+	if err != nil { _ = os.Remove( s.caFile ); return nil, err }
+	
+	mux := http.NewServeMux()
+	for _, version := range []string{ "/v1.0.0", "/v1" } {
+		mux.HandleFunc( "POST " + version + ConnectPath, s.endpoint( ConnectPath, s.connect ) )
+		mux.HandleFunc( "POST " + version + DisconnectPath, s.endpoint( DisconnectPath, s.disconnect ) )
+		mux.HandleFunc( "POST " + version + AccessTokenPath, s.endpoint( AccessTokenPath, s.accessToken ) )
+	}
+	mux.HandleFunc( "POST " + FilterPath, s.endpoint( FilterPath, s.filter ) )
+	mux.HandleFunc( "POST " + PortForwardPath, s.endpoint( PortForwardPath, s.portForward ) )
+	mux.HandleFunc( "GET " + CategoriesPath, s.endpoint( CategoriesPath, func( w http.ResponseWriter, _ *http.Request ) { s.Lock(); defer s.Unlock(); writeJson( w, s.categories ) } ) )
+	mux.HandleFunc( "GET " + ServerListPath, s.endpoint( ServerListPath, func( w http.ResponseWriter, _ *http.Request ) { s.Lock(); defer s.Unlock(); writeJson( w, s.serverList ) } ) )
+	mux.HandleFunc( "GET " + IpCheckPath + "{$}", s.endpoint( IpCheckPath, s.ipCheck ) )
+	
+	s.Server = httptest.NewUnstartedServer( mux )
+	s.Server.EnableHTTP2 = true
+	s.Server.TLS = &tls.Config{ Certificates: []tls.Certificate{ s.authority.certificate } }
+	s.Server.StartTLS()
+	return
+}
+
+// Close stops the server and removes the CA file
+func ( s *Server ) Close() { s.Server.Close(); _ = os.Remove( s.caFile ) }
+
+// CAFile returns the name of a file which holds the root CA certificate, to be used as rest.Config CA
+func ( s *Server ) CAFile() string { return s.caFile }
+
+// Pins returns a pin set of the generated CAs, to be used with rest.Client SetPins. The intermediate CA pin is the primary one, the root CA pin is the backup
+func ( s *Server ) Pins() rest.PinSet {
+	return rest.PinSet{ Primary: []string{ rest.Pin( s.authority.intermediate ) }, Backup: []string{ rest.Pin( s.authority.root ) } }
+}
+
+// Config returns a REST client configuration which reaches this server as host, api.hide.me and ipcheck(-v6).hideservers.net through the "hosts" resolver. The in-tunnel endpoint is this server too
+func ( s *Server ) Config( host string ) *rest.Config {
+	address := s.Listener.Addr().( *net.TCPAddr )
+	return &rest.Config{
+		APIVersion:			"v1.0.0",
+		Host:				host,
+		Port:				address.Port,
+		Domain:				"hide.me",
+		CA:					s.caFile,
+		RestTimeout:		10 * time.Second,
+		Resolvers:			[]string{ resolvers.Hosts },
+		Hosts:				map[string][]string{ host: { address.IP.String() }, "api.hide.me": { address.IP.String() }, "ipcheck.hideservers.net": { address.IP.String() }, "ipcheck-v6.hideservers.net": { address.IP.String() } },
+		InTunnelEndpoint:	address.String(),
+		PublicPort:			address.Port,
+		PublicCA:			s.caFile,
+	}
+}
+
+// Client returns an initialized REST client which trusts this server and resolves host to it
+func ( s *Server ) Client( host string ) ( client *rest.Client, err error ) {
+	config := s.Config( host )
+	client = rest.New( config )
+	for _, class := range []string{ rest.PinClassVpn, rest.PinClassApi, rest.PinClassIpCheck } { client.SetPins( class, s.Pins() ) }
+	client.SetResolver( resolvers.Hosts, resolvers.HostMap( config.Hosts ) )
+	err = client.Init()
+	return
+}
+
+// SetFault makes an endpoint misbehave, a zero Fault restores the regular behavior
+func ( s *Server ) SetFault( path string, fault Fault ) {
+	s.Lock(); defer s.Unlock()
+	if fault == ( Fault{} ) { delete( s.faults, path ); return }
+	s.faults[path] = fault
+}
+
+// SetStaleAccessToken sets the stale Access-Token flag of the connect responses
+func ( s *Server ) SetStaleAccessToken( stale bool ) { s.Lock(); s.staleAccessToken = stale; s.Unlock() }
+
+func ( s *Server ) SetCategories( categories []Category ) { s.Lock(); s.categories = categories; s.Unlock() }
+func ( s *Server ) SetServerList( serverList []locations.Location ) { s.Lock(); s.serverList = serverList; s.Unlock() }
+
+// AddAccessToken makes the server accept an Access-Token it has not issued
+func ( s *Server ) AddAccessToken( accessToken []byte ) { s.Lock(); s.accessTokens[base64.StdEncoding.EncodeToString( accessToken )] = true; s.Unlock() }
+
+// Requests returns the number of requests an endpoint received, including the failed ones
+func ( s *Server ) Requests( path string ) int { s.Lock(); defer s.Unlock(); return s.requests[path] }
+
+// Sessions returns the number of connected sessions
+func ( s *Server ) Sessions() int { s.Lock(); defer s.Unlock(); return len( s.sessions ) }
+
+// LastFilter returns the filter settings posted last
+func ( s *Server ) LastFilter() *rest.Filter { s.Lock(); defer s.Unlock(); return s.lastFilter }
+
+// ServerPublicKey returns the WireGuard public key the server hands out in connect responses
+func ( s *Server ) ServerPublicKey() wgtypes.Key { return s.serverKey.PublicKey() }
+
+// endpoint counts the requests and applies the faults before calling the handler
+func ( s *Server ) endpoint( path string, handler http.HandlerFunc ) http.HandlerFunc {
+	return func( w http.ResponseWriter, r *http.Request ) {
+		s.Lock()
+		s.requests[path]++
+		fault := s.faults[path]
+		s.Unlock()
+		if fault.Delay > 0 {
+			select {
+				case <-time.After( fault.Delay ):
+				case <-r.Context().Done(): return
+			}
+		}
+		switch {
+			case fault.Status != 0:		w.WriteHeader( fault.Status ); _, _ = io.WriteString( w, fault.Body )
+			case len( fault.Body ) > 0:	_, _ = io.WriteString( w, fault.Body )
+			default:					handler( w, r )
+		}
+	}
+}
+
+func writeJson( w http.ResponseWriter, object any ) {
+	w.Header().Set( "content-type", "application/json" )
+	_ = json.NewEncoder( w ).Encode( object )
+}
+
+// readJson decodes a request body, a bad body gets a 400 response
+func readJson( w http.ResponseWriter, r *http.Request, object any ) bool {
+	if err := json.NewDecoder( r.Body ).Decode( object ); err != nil { http.Error( w, err.Error(), http.StatusBadRequest ); return false }
+	return true
+}
+
+func randomToken() []byte { token := make( []byte, 32 ); _, _ = rand.Read( token ); return token }
+
+// accessToken issues an Access-Token for valid credentials or for a valid Access-Token
+func ( s *Server ) accessToken( w http.ResponseWriter, r *http.Request ) {
+	request := &rest.AccessTokenRequest{}
+	if !readJson( w, r, request ) { return }
+	if err := request.Check(); err != nil { http.Error( w, err.Error(), http.StatusBadRequest ); return }
+	s.Lock(); defer s.Unlock()
+	switch {
+		case len( request.AccessToken ) > 0:	if !s.accessTokens[base64.StdEncoding.EncodeToString( request.AccessToken )] { http.Error( w, "bad Access-Token", http.StatusUnauthorized ); return }
+		default:								if request.Username != s.username || request.Password != s.password { http.Error( w, "bad credentials", http.StatusUnauthorized ); return }
+	}
+	accessToken := base64.StdEncoding.EncodeToString( randomToken() )
+	s.accessTokens[accessToken] = true
+	writeJson( w, accessToken )
+}
+
+// connect establishes a session for a valid Access-Token
+func ( s *Server ) connect( w http.ResponseWriter, r *http.Request ) {
+	request := &rest.ConnectRequest{}
+	if !readJson( w, r, request ) { return }
+	if err := request.Check(); err != nil { http.Error( w, err.Error(), http.StatusBadRequest ); return }
+	if _, err := wgtypes.NewKey( request.PublicKey ); err != nil { http.Error( w, err.Error(), http.StatusBadRequest ); return }
+	s.Lock(); defer s.Unlock()
+	if !s.accessTokens[base64.StdEncoding.EncodeToString( request.AccessToken )] { http.Error( w, "bad Access-Token", http.StatusUnauthorized ); return }
+	
+	sessionToken, publicKey := randomToken(), s.serverKey.PublicKey()
+	s.sessions[base64.StdEncoding.EncodeToString( sessionToken )] = true
+	writeJson( w, &rest.ConnectResponse{
+		PublicKey:					publicKey[:],
+		Endpoint:					net.UDPAddr{ IP: net.IPv4( 127, 0, 0, 1 ), Port: 432 },
+		PersistentKeepaliveInterval: 20 * time.Second,
+		AllowedIps:					[]net.IP{ net.ParseIP( "10.128.0.2" ), net.ParseIP( "fd00:6968:6564:6d65::2" ) },
+		DNS:						[]net.IP{ net.ParseIP( "10.128.0.1" ), net.ParseIP( "fd00:6968:6564:6d65::1" ) },
+		Gateway:					[]net.IP{ net.ParseIP( "10.128.0.1" ), net.ParseIP( "fd00:6968:6564:6d65::1" ) },
+		StaleAccessToken:			s.staleAccessToken,
+		SessionToken:				sessionToken,
+	})
+}
+
+// disconnect ends a session
+func ( s *Server ) disconnect( w http.ResponseWriter, r *http.Request ) {
+	request := &rest.DisconnectRequest{}
+	if !readJson( w, r, request ) { return }
+	if err := request.Check(); err != nil { http.Error( w, err.Error(), http.StatusBadRequest ); return }
+	s.Lock(); defer s.Unlock()
+	sessionToken := base64.StdEncoding.EncodeToString( request.SessionToken )
+	if !s.sessions[sessionToken] { http.Error( w, "unknown session", http.StatusNotFound ); return }
+	delete( s.sessions, sessionToken )
+	writeJson( w, true )
+}
+
+func ( s *Server ) filter( w http.ResponseWriter, r *http.Request ) {
+	filter := &rest.Filter{}
+	if !readJson( w, r, filter ) { return }
+	if err := filter.Check(); err != nil { writeJson( w, false ); return }
+	s.Lock(); s.lastFilter = filter; s.Unlock()
+	writeJson( w, true )
+}
+
+func ( s *Server ) portForward( w http.ResponseWriter, r *http.Request ) {
+	portForward := &rest.PortForward{}
+	if !readJson( w, r, portForward ) { return }
+	writeJson( w, true )
+}
+
+// ipCheck responds with the address the request came from
+func ( s *Server ) ipCheck( w http.ResponseWriter, r *http.Request ) {
+	host, _, err := net.SplitHostPort( r.RemoteAddr )
+	if err != nil { http.Error( w, err.Error(), http.StatusBadRequest ); return }
+	_, _ = io.WriteString( w, host )
+}
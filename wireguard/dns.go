@@ -1,51 +1,214 @@
 package wireguard
 
 import (
+	"bytes"
+	"errors"
 	"golang.org/x/sys/unix"
-	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
 )
 
-// Update the system-wide DNS
-func (l *Link) dnsSet( addrs []net.IP ) ( err error ) {
-	file, err := os.OpenFile( "/etc/resolv.conf", os.O_RDWR, 0644 )																						// Open /etc/resolv.conf
-	if err != nil { log.Println( "Link: [ERR] Open /etc/resolv.conf failed" ); return }
-	if l.resolvConf, err = io.ReadAll( file ); err != nil { log.Println( "Link: [ERR] Read /etc/resolv.conf failed" ); return }
-	if len( l.Config.ResolvConfBackupFile ) > 0 {																										// Backup old resolv.conf if configured to do so
-		switch err = os.WriteFile( l.Config.ResolvConfBackupFile, l.resolvConf, 0644 ); err {
-			case nil: log.Println( "Link: resolv.conf backup in", l.Config.ResolvConfBackupFile )
-			default:  log.Println( "Link: [WARN] resolv.conf backup to", l.Config.ResolvConfBackupFile, "failed:", err.Error() )						// Backup may fail. The contents of the original resolv.conf are kept in l.resolvConf and can be restored
+const (
+	resolvConfPath = "/etc/resolv.conf"
+	resolvConfMarker = "# Generated by hide.me CLI, the original content gets restored on disconnect\n"														// Identifies resolv.conf content left behind by a crashed hide.me CLI
+)
+
+// defaultResolvConfTemplate is used when no resolv.conf template has been configured
+const defaultResolvConfTemplate = `options timeout:1{{ range .Options }} {{ . }}{{ end }}
+{{ if .Search }}search{{ range .Search }} {{ . }}{{ end }}
+{{ else if .Domain }}domain {{ .Domain }}
+{{ end }}{{ range .Nameservers }}nameserver {{ . }}
+{{ end }}`
+
+// resolvConfData is made available to the resolv.conf template
+type resolvConfData struct {
+	Nameservers	[]net.IP																																	// Tunnel DNS servers ( or the local forwarder )
+	Search		[]string																																	// Tunnel search domains followed by the kept original ones
+	Domain		string																																		// Kept original local domain
+	Options		[]string																																	// Kept original options
+}
+
+func parseResolvConfTemplate( text string ) ( *template.Template, error ) {
+	if len( text ) == 0 { text = defaultResolvConfTemplate }
+	return template.New( "resolv.conf" ).Parse( text )
+}
+
+// resolvConfContent creates the resolv.conf content pointing to the tunnel DNS servers. The configured directives and options of the original resolv.conf are kept
+func ( l *Link ) resolvConfContent( addrs []net.IP, search []string, original []byte ) ( content []byte, err error ) {
+	data := resolvConfData{ Nameservers: addrs, Search: slices.Clone( search ) }
+	keep := map[string]bool{}
+	for _, directive := range l.Config.ResolvConfKeep { keep[directive] = true }
+	for line := range strings.Lines( string( original ) ) {
+		fields := strings.Fields( line )
+		if len( fields ) < 2 { continue }
+		switch fields[0] {
+			case "search":	if keep["search"] { data.Search = append( data.Search, fields[1:]... ) }
+			case "domain":	if keep["domain"] { data.Domain = fields[1] }
+			case "options":
+				for _, option := range fields[1:] { if name, _, _ := strings.Cut( option, ":" ); keep[name] { data.Options = append( data.Options, option ) } }
 		}
 	}
+	if len( data.Search ) > 0 && len( data.Domain ) > 0 { data.Search = append( data.Search, data.Domain ) }												// search overrides domain, so the local domain joins the search list
+	slices.Sort( data.Options )
+	data.Search, data.Options = dedupe( data.Search ), slices.Compact( data.Options )
+
+	tmpl, err := parseResolvConfTemplate( l.Config.ResolvConfTemplate )
+	if err != nil { log.Println( "Link: [ERR] Bad resolv.conf template:", err ); return }
+	buf := bytes.Buffer{}
+	if err = tmpl.Execute( &buf, data ); err != nil { log.Println( "Link: [ERR] resolv.conf template execution failed:", err ); return }
+	return buf.Bytes(), nil
+}
+
+// dedupe removes repeated strings keeping the order of the first occurrences
+func dedupe( list []string ) ( deduped []string ) {
+	for _, item := range list { if !slices.Contains( deduped, item ) { deduped = append( deduped, item ) } }
+	return
+}
+
+// resolvConfNameservers extracts the nameserver addresses from resolv.conf content
+func resolvConfNameservers( content []byte ) ( nameservers []net.IP ) {
+	for line := range strings.Lines( string( content ) ) {
+		fields := strings.Fields( line )
+		if len( fields ) < 2 || fields[0] != "nameserver" { continue }
+		if ip := net.ParseIP( strings.Split( fields[1], "%" )[0] ); ip != nil { nameservers = append( nameservers, ip ) }				// Drop IPv6 zones
+	}
+	return
+}
+
+// fileDns rewrites /etc/resolv.conf in place
+type fileDns struct {
+	sync.Mutex
+	link		*Link
+	resolvConf	[]byte																																	// resolv.conf backup
+	content		[]byte																																	// resolv.conf content pointing to the tunnel DNS
+	addrs		[]net.IP
+	search		[]string
+	watcher		*resolvConfWatcher																														// Re-applies the tunnel DNS when someone else overwrites resolv.conf
+}
 
-	nameServers := "options timeout:1\n"																												// Create new content
-	for _, addr := range addrs { nameServers += "nameserver " + addr.String() + "\n" }
-	
-	if _, err = file.Seek( 0, unix.SEEK_SET ); err != nil { log.Println( "Link: [ERR] Seek in /etc/resolv.conf failed" ); return }						// Seek to start
-	if _, err = file.WriteString( nameServers ); err != nil { log.Println( "Link: [ERR] /etc/resolv.conf update failed" ); return }						// Update
-	if err = file.Truncate( int64( len( nameServers ) ) ); err != nil { log.Println( "Link: [WARN] Truncate /etc/resolv.conf failed" ) }				// Truncate resolv.conf
+func ( f *fileDns ) Name() string { return DnsFile }
+
+// backup keeps the original resolv.conf content, in the backup file too when configured to do so
+func ( f *fileDns ) backup( resolvConf []byte ) {
+	f.resolvConf = resolvConf
+	if len( f.link.Config.ResolvConfBackupFile ) == 0 { return }																						// Backup old resolv.conf if configured to do so
+	switch err := os.WriteFile( f.link.Config.ResolvConfBackupFile, f.resolvConf, 0644 ); err {
+		case nil: log.Println( "Link: resolv.conf backup in", f.link.Config.ResolvConfBackupFile )
+		default:  log.Println( "Link: [WARN] resolv.conf backup to", f.link.Config.ResolvConfBackupFile, "failed:", err.Error() )						// Backup may fail. The contents of the original resolv.conf are kept in f.resolvConf and can be restored
+	}
+}
+
+// writeInPlace rewrites a file in place
+func writeInPlace( path string, content []byte ) ( err error ) {
+	file, err := os.OpenFile( path, os.O_RDWR, 0644 )
+	if err != nil { log.Println( "Link: [ERR] Open", path, "failed:", err ); return }
+	defer file.Close()
+	if _, err = file.Seek( 0, unix.SEEK_SET ); err != nil { log.Println( "Link: [ERR] Seek in", path, "failed:", err ); return }						// Seek to start
+	if _, err = file.Write( content ); err != nil { log.Println( "Link: [ERR]", path, "update failed:", err ); return }									// Update
+	if err = file.Truncate( int64( len( content ) ) ); err != nil { log.Println( "Link: [WARN] Truncate", path, "failed:", err ) }						// Truncate
+	return
+}
+
+// writeResolvConf atomically replaces the content of /etc/resolv.conf. A symlinked /etc/resolv.conf stays a symlink as its final target gets replaced, bind mounted files get rewritten in place
+func writeResolvConf( content []byte ) ( err error ) {
+	target, err := filepath.EvalSymlinks( resolvConfPath )
+	if err != nil { log.Println( "Link: [ERR] Resolve", resolvConfPath, "symlinks failed:", err ); return }
+	info, err := os.Stat( target )
+	if err != nil { log.Println( "Link: [ERR] Stat", target, "failed:", err ); return }
+	temp, err := os.CreateTemp( filepath.Dir( target ), ".resolv.conf.hide.me-" )
+	if err != nil { log.Println( "Link: [WARN] Temporary file creation failed, rewriting", target, "in place:", err ); return writeInPlace( target, content ) }
+	defer func() { if err != nil { _ = os.Remove( temp.Name() ) } }()
+	if _, err = temp.Write( content ); err != nil { _ = temp.Close(); log.Println( "Link: [ERR] Write to", temp.Name(), "failed:", err ); return }
+	if err = temp.Chmod( info.Mode().Perm() ); err != nil { _ = temp.Close(); log.Println( "Link: [ERR] Chmod", temp.Name(), "failed:", err ); return }		// Keep the mode and the ownership
+	if stat, ok := info.Sys().( *unix.Stat_t ); ok { _ = temp.Chown( int( stat.Uid ), int( stat.Gid ) ) }
+	if err = temp.Sync(); err != nil { _ = temp.Close(); log.Println( "Link: [ERR] Sync", temp.Name(), "failed:", err ); return }
+	if err = temp.Close(); err != nil { log.Println( "Link: [ERR] Close", temp.Name(), "failed:", err ); return }
+	if err = os.Rename( temp.Name(), target ); err != nil {																								// Rename fails on bind mounts ( containers ) with EBUSY
+		log.Println( "Link: [WARN] Rename to", target, "failed, rewriting it in place:", err )
+		_ = os.Remove( temp.Name() )
+		return writeInPlace( target, content )
+	}
+	return
+}
+
+// Set updates the system-wide DNS
+func ( f *fileDns ) Set( addrs []net.IP, search []string ) ( err error ) {
+	f.Lock(); defer f.Unlock()
+	resolvConf, err := os.ReadFile( resolvConfPath )
+	if err != nil { log.Println( "Link: [ERR] Read /etc/resolv.conf failed" ); return }
+	f.backup( resolvConf )
+
+	if f.content, err = f.link.resolvConfContent( addrs, search, resolvConf ); err != nil { return }														// Create new content
+	f.content = append( []byte( resolvConfMarker ), f.content... )
+	f.addrs, f.search = addrs, search
+	if err = writeResolvConf( f.content ); err != nil { return }
 	log.Println( "Link: /etc/resolv.conf updated" )
 
+	if f.watcher, err = watchResolvConf( f.reapply ); err != nil { log.Println( "Link: [WARN] /etc/resolv.conf changes will not be detected" ); err = nil }
 	return
 }
 
-func (l *Link) dnsRestore() ( err error ) {
-	if l.resolvConf == nil { return }																													// No backup taken
+// reapply puts the tunnel DNS back after someone else overwrote /etc/resolv.conf. The foreign content becomes the new backup
+func ( f *fileDns ) reapply() {
+	f.Lock(); defer f.Unlock()
+	if f.content == nil { return }																														// Restored already
+	resolvConf, err := os.ReadFile( resolvConfPath )
+	if err != nil { log.Println( "Link: [ERR] Read /etc/resolv.conf failed:", err ); return }
+	if bytes.Equal( resolvConf, f.content ) { return }																									// Our own write
+	log.Println( "Link: [WARN] /etc/resolv.conf has been overwritten, re-applying the tunnel DNS" )
+	f.backup( resolvConf )
+	content, err := f.link.resolvConfContent( f.addrs, f.search, resolvConf )																			// Directives of the new content may have changed
+	if err != nil { return }
+	f.content = append( []byte( resolvConfMarker ), content... )
+	if err = writeResolvConf( f.content ); err != nil { return }
+	log.Println( "Link: /etc/resolv.conf updated" )
+}
 
-	file, err := os.OpenFile( "/etc/resolv.conf", os.O_RDWR, 0644 )																						// Open /etc/resolv.conf
-	if err != nil { log.Println( "Link: [ERR] Open /etc/resolv.conf failed" ); return }
-	if _, err = file.Seek( 0, unix.SEEK_SET ); err != nil { log.Println( "Link: [ERR] Seek in /etc/resolv.conf failed" ); return }						// Seek to start
-	if _, err = file.Write( l.resolvConf ); err != nil { log.Println( "Link: [WARN] /etc/resolv.conf restore failed" ); return }						// Update
-	if err = file.Truncate( int64( len( l.resolvConf ) ) ); err != nil { log.Println( "Link: [WARN] Truncate /etc/resolv.conf failed" ) }				// Truncate resolv.conf
+// resolvConfRecover restores /etc/resolv.conf from the backup file when a previous run has not restored it ( crash, power loss )
+func ( l *Link ) resolvConfRecover() {
+	resolvConf, err := os.ReadFile( resolvConfPath )
+	if err != nil || !bytes.HasPrefix( resolvConf, []byte( resolvConfMarker ) ) { return }																// Not our content
+	if len( l.Config.ResolvConfBackupFile ) == 0 { log.Println( "Link: [WARN]", resolvConfPath, "has been left behind by a previous run, but no backup file is configured" ); return }
+	backup, err := os.ReadFile( l.Config.ResolvConfBackupFile )
+	if err != nil { log.Println( "Link: [WARN]", resolvConfPath, "has been left behind by a previous run, but the backup can't be read:", err ); return }
+	if err = writeResolvConf( backup ); err != nil { log.Println( "Link: [ERR]", resolvConfPath, "recovery from", l.Config.ResolvConfBackupFile, "failed" ); return }
+	log.Println( "Link:", resolvConfPath, "left behind by a previous run restored from", l.Config.ResolvConfBackupFile )
+	if err = os.Remove( l.Config.ResolvConfBackupFile ); err != nil { log.Println( "Link: [ERR] Removal of", l.Config.ResolvConfBackupFile, "failed,", err ) }
+}
+
+// OriginalResolvConf returns the resolv.conf content as it was before the tunnel DNS got applied. While /etc/resolv.conf holds the generated content the backup gets returned instead
+func ( l *Link ) OriginalResolvConf() ( content []byte, err error ) {
+	if f, ok := l.dns.( *fileDns ); ok {
+		f.Lock(); content = f.resolvConf; f.Unlock()
+		if content != nil { return }
+	}
+	if content, err = os.ReadFile( resolvConfPath ); err != nil || !bytes.HasPrefix( content, []byte( resolvConfMarker ) ) { return }				// Not our content, so it's the original one
+	if len( l.Config.ResolvConfBackupFile ) == 0 { return nil, errors.New( resolvConfPath + " holds the tunnel DNS and no backup file is configured" ) }
+	return os.ReadFile( l.Config.ResolvConfBackupFile )																								// Another instance is connected
+}
+
+// Restore puts the original /etc/resolv.conf back in place
+func ( f *fileDns ) Restore() ( err error ) {
+	f.Lock(); defer f.Unlock()
+	if f.watcher != nil { f.watcher.Close(); f.watcher = nil }
+	f.content = nil
+	if f.resolvConf == nil { return }																													// No backup taken
+
+	if err = writeResolvConf( f.resolvConf ); err != nil { log.Println( "Link: [WARN] /etc/resolv.conf restore failed" ); return }
 	log.Println( "Link: /etc/resolv.conf restored" )
+	f.resolvConf = nil
 
-	if len( l.Config.ResolvConfBackupFile ) > 0 {
-		switch err = os.Remove( l.Config.ResolvConfBackupFile ); err {
-			case nil: log.Println( "Link: resolv.conf backup in", l.Config.ResolvConfBackupFile, "removed" )
-			default:  log.Println( "Link: [ERR] Removal of", l.Config.ResolvConfBackupFile, "failed, ", err.Error() )
+	if len( f.link.Config.ResolvConfBackupFile ) > 0 {
+		switch err = os.Remove( f.link.Config.ResolvConfBackupFile ); err {
+			case nil: log.Println( "Link: resolv.conf backup in", f.link.Config.ResolvConfBackupFile, "removed" )
+			default:  log.Println( "Link: [ERR] Removal of", f.link.Config.ResolvConfBackupFile, "failed, ", err.Error() )
 		}
 	}
 	return
-}
\ No newline at end of file
+}
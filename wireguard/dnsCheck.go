@@ -0,0 +1,152 @@
+package wireguard
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+const dnsCheckName = "hide.me."																														// Name used for the test queries
+
+type DnsCheckItem struct {
+	Name		string		`json:"name"`																											// What was checked
+	Passed		bool		`json:"passed"`
+	Detail		string		`json:"detail,omitempty"`																								// Failure reason or additional information
+}
+
+type DnsCheck struct {
+	Timestamp	time.Time		`json:"timestamp"`
+	Passed		bool			`json:"passed"`																									// True when all the items passed
+	Items		[]DnsCheckItem	`json:"items"`
+}
+
+func ( c *DnsCheck ) add( name string, err error, detail string ) {
+	item := DnsCheckItem{ Name: name, Passed: err == nil, Detail: detail }
+	if err != nil { item.Detail = err.Error(); c.Passed = false; log.Println( "DnsC: [ERR]", name, "failed:", err ) } else { log.Println( "DnsC:", name, "passed", detail ) }
+	c.Items = append( c.Items, item )
+}
+
+// Attach looks up an already existing wireguard interface without altering it, for inspection purposes only
+func ( l *Link ) Attach() ( err error ) {
+	if l.wireguardLink, err = netlink.LinkByName( l.Config.Name ); err != nil { log.Println( "Link: [ERR] Interface lookup", l.Config.Name, "failed:", err ) }
+	return
+}
+
+// splitTunnelNetwork returns the split-tunnel network ip belongs to, nil if none
+func ( l *Link ) splitTunnelNetwork( ip net.IP ) *net.IPNet {
+	for _, network := range splitTunnelNetworks( l.Config.SplitTunnel ) { if network.Contains( ip ) { return network } }
+	return nil
+}
+
+// resolvedLinkDns fetches the DNS servers systemd-resolved uses for an interface
+func resolvedLinkDns( ifIndex int ) ( servers []net.IP, err error ) {
+	conn, err := dbus.SystemBus()
+	if err != nil { return }
+	var linkPath dbus.ObjectPath
+	if err = conn.Object( resolvedBusName, resolvedObjectPath ).Call( resolvedManager + ".GetLink", 0, int32( ifIndex ) ).Store( &linkPath ); err != nil { return }
+	variant, err := conn.Object( resolvedBusName, linkPath ).GetProperty( "org.freedesktop.resolve1.Link.DNS" )
+	if err != nil { return }
+	addrs := []resolvedAddress(nil)
+	if err = variant.Store( &addrs ); err != nil { return }
+	for _, addr := range addrs { servers = append( servers, net.IP( addr.Address ) ) }
+	return
+}
+
+// dnsQuery sends a test query to server, bound to device when device is not empty
+func dnsQuery( ctx context.Context, server net.IP, device string ) ( err error ) {
+	dialer := &net.Dialer{}
+	if len( device ) > 0 {
+		dialer.Control = func( network, address string, rawConn syscall.RawConn ) ( err error ) {
+			_ = rawConn.Control( func( fd uintptr ) { err = unix.BindToDevice( int( fd ), device ) } )
+			return
+		}
+	}
+	conn, err := dialer.DialContext( ctx, "udp", net.JoinHostPort( server.String(), "53" ) )
+	if err != nil { return }
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok { _ = conn.SetDeadline( deadline ) }
+
+	id := uint16( rand.Uint32() )
+	query := dnsmessage.Message{
+		Header:		dnsmessage.Header{ ID: id, RecursionDesired: true },
+		Questions:	[]dnsmessage.Question{ { Name: dnsmessage.MustNewName( dnsCheckName ), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET } },
+	}
+	buf, err := query.Pack()
+	if err != nil { return }
+	if _, err = conn.Write( buf ); err != nil { return }
+	buf = make( []byte, 65535 )
+	n, err := conn.Read( buf )
+	if err != nil { return }
+	response := dnsmessage.Message{}
+	if err = response.Unpack( buf[:n] ); err != nil { return }
+	if !response.Header.Response || response.Header.ID != id { return errors.New( "bad response" ) }
+	if response.Header.RCode != dnsmessage.RCodeSuccess { return errors.New( "bad response code " + response.Header.RCode.String() ) }
+	return
+}
+
+// DnsCheck verifies that the effective resolver configuration points to the tunnel DNS, that the tunnel DNS servers are routed through the tunnel and that they answer through the tunnel
+func ( l *Link ) DnsCheck( ctx context.Context ) ( check *DnsCheck ) {
+	check = &DnsCheck{ Timestamp: time.Now(), Passed: true }
+	if l.wireguardLink == nil { check.add( "interface", errors.New( "interface " + l.Config.Name + " is not up" ), "" ); return }
+
+	content, err := os.ReadFile( resolvConfPath )
+	if err != nil { check.add( "resolver configuration", err, "" ); return }
+	nameservers := resolvConfNameservers( content )
+	servers, expected, dnsState := []net.IP(nil), []net.IP(nil), l.dnsState
+	if dnsState != nil {																																// Tunnel DNS applied by this process
+		servers, expected = dnsState.Servers, dnsState.Servers
+		if dnsState.Forwarder != nil { expected = []net.IP{ dnsState.Forwarder } }
+	}
+
+	switch resolvedStub := len( nameservers ) == 1 && nameservers[0].Equal( net.IPv4( 127, 0, 0, 53 ) ); {											// Resolver configuration check
+		case len( nameservers ) == 0:
+			check.add( "resolver configuration", errors.New( "no nameservers in " + resolvConfPath ), "" )
+		case resolvedStub:																																// systemd-resolved, check the interface's DNS servers
+			linkDns, err := resolvedLinkDns( l.wireguardLink.Attrs().Index )
+			switch {
+				case err != nil:			check.add( "resolver configuration", err, "" )
+				case len( linkDns ) == 0:	check.add( "resolver configuration", errors.New( "systemd-resolved has no DNS servers for " + l.Config.Name ), "" )
+				case expected != nil && !slices.EqualFunc( linkDns, expected, net.IP.Equal ):
+					check.add( "resolver configuration", errors.New( "systemd-resolved DNS servers for " + l.Config.Name + " do not match the tunnel DNS" ), "" )
+				default:					check.add( "resolver configuration", nil, "systemd-resolved" ); if servers == nil { servers = linkDns }
+			}
+		case expected != nil:
+			for _, nameserver := range nameservers {
+				if !slices.ContainsFunc( expected, nameserver.Equal ) { check.add( "resolver configuration", errors.New( "nameserver " + nameserver.String() + " is not a tunnel DNS server" ), "" ); break }
+			}
+			if check.Passed { check.add( "resolver configuration", nil, resolvConfPath ) }
+		default:																																		// Tunnel DNS not applied by this process, check the nameservers themselves
+			check.add( "resolver configuration", nil, resolvConfPath )
+			servers = nameservers
+	}
+
+	for _, server := range servers {																													// Route and query checks
+		device := l.Config.Name
+		switch network := l.splitTunnelNetwork( server ); {
+			case server.IsLoopback():		check.add( "route " + server.String(), errors.New( "local forwarder with unknown upstream servers" ), "" ); continue		// The forwarder of this process is checked through its upstream servers
+			case network != nil:			check.add( "route " + server.String(), nil, "split-tunnel route " + network.String() ); device = ""
+			case l.Tunneled( server ):		check.add( "route " + server.String(), nil, "via " + l.Config.Name )
+			default:						check.add( "route " + server.String(), errors.New( "not routed through " + l.Config.Name ), "" ); continue
+		}
+		queryCtx, cancel := context.WithTimeout( ctx, 2 * time.Second )
+		err = dnsQuery( queryCtx, server, device )
+		cancel()
+		switch {
+			case err != nil:		check.add( "query " + server.String(), err, "" )
+			case len( device ) > 0:	check.add( "query " + server.String(), nil, "answered through " + device )
+			default:				check.add( "query " + server.String(), nil, "answered" )
+		}
+	}
+	return
+}
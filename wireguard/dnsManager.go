@@ -0,0 +1,158 @@
+package wireguard
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DnsAuto = "auto"																																	// Detect the DNS backend from the /etc/resolv.conf symlink target
+	DnsResolved = "resolved"																															// systemd-resolved over D-Bus
+	DnsResolvconf = "resolvconf"																														// resolvconf/openresolv interface registration
+	DnsFile = "file"																																	// Rewrite /etc/resolv.conf in place
+	DnsNone = "none"																																	// Leave DNS alone
+)
+
+type DnsState struct {
+	Manager		string		`json:"manager"`																											// DNS manager in use
+	Servers		[]net.IP	`json:"servers,omitempty"`																									// DNS servers in use
+	Forwarder	net.IP		`json:"forwarder,omitempty"`																								// Local DNS forwarder address the system DNS points to ( if any )
+	Search		[]string	`json:"search,omitempty"`																									// Search domains in use
+}
+
+// DnsForwarder is a local DNS forwarder the system DNS configuration points to instead of the tunnel DNS servers
+type DnsForwarder interface {
+	Start( upstreams []net.IP, tunneled func( ip net.IP ) bool ) ( listen net.IP, err error )
+	Stop() ( err error )
+}
+
+// DnsManager applies the tunnel DNS configuration to the system and removes it afterwards
+type DnsManager interface {
+	Name() string
+	Set( addrs []net.IP, search []string ) ( err error )
+	Restore() ( err error )
+}
+
+func checkDns( c *Config ) ( err error ) {
+	for _, server := range c.DnsServers { if net.ParseIP( server ) == nil { return errors.New( "bad DNS server address " + server ) } }
+	for _, domain := range c.DnsSearch { if len( domain ) == 0 || strings.ContainsAny( domain, " \t\n" ) { return errors.New( "bad DNS search domain \"" + domain + "\"" ) } }
+	if _, err = parseResolvConfTemplate( c.ResolvConfTemplate ); err != nil { return errors.New( "bad resolv.conf template: " + err.Error() ) }
+	return checkDnsManager( c.DnsManager )
+}
+
+func checkDnsManager( dnsManager string ) ( err error ) {
+	switch dnsManager {
+		case "", DnsAuto, DnsResolved, DnsResolvconf, DnsFile, DnsNone: return
+		default: return errors.New( "unsupported DNS manager " + dnsManager )
+	}
+}
+
+// SetDnsForwarder sets a local DNS forwarder to run while the tunnel DNS is applied, nil disables it
+func ( l *Link ) SetDnsForwarder( dnsForwarder DnsForwarder ) { l.dnsForwarder = dnsForwarder }
+
+// SetDnsManager plugs in a DNS manager, overriding the configured one
+func ( l *Link ) SetDnsManager( dnsManager DnsManager ) { l.dnsManager = dnsManager }
+
+// newDnsManager creates the configured DNS manager
+func ( l *Link ) newDnsManager() DnsManager {
+	switch l.Config.DnsManager {
+		case DnsResolved:	return &resolvedDns{ link: l }
+		case DnsResolvconf:	return &resolvconfDns{ link: l }
+		case DnsFile:		return &fileDns{ link: l }
+		case DnsNone:		return noneDns{}
+		default:			return l.detectDnsManager()
+	}
+}
+
+// detectDnsManager picks a DNS manager according to the /etc/resolv.conf symlink target and contents
+func ( l *Link ) detectDnsManager() DnsManager {
+	target, err := filepath.EvalSymlinks( resolvConfPath )
+	if err != nil { log.Println( "Link: [WARN] Resolve", resolvConfPath, "symlinks failed:", err ); return &fileDns{ link: l } }
+	switch {
+		case target == "/run/systemd/resolve/stub-resolv.conf":																							// systemd-resolved stub resolver is in use, /run/systemd/resolve/resolv.conf lists upstream servers directly so it's handled as a file
+			if resolvedRunning() { log.Println( "Link: Detected systemd-resolved" ); return &resolvedDns{ link: l } }
+			log.Println( "Link: [WARN]", resolvConfPath, "points to", target, "but systemd-resolved is not running" )
+		case strings.HasPrefix( target, "/run/resolvconf/" ), strings.HasPrefix( target, "/etc/resolvconf/run/" ):										// Debian resolvconf
+			if _, err = exec.LookPath( "resolvconf" ); err == nil { log.Println( "Link: Detected resolvconf" ); return &resolvconfDns{ link: l } }
+			log.Println( "Link: [WARN]", resolvConfPath, "points to", target, "but resolvconf is not installed" )
+		default:																																		// openresolv writes /etc/resolv.conf directly, but leaves a signature
+			if content, err := os.ReadFile( target ); err == nil && bytes.Contains( content, []byte( "Generated by resolvconf" ) ) {
+				if _, err = exec.LookPath( "resolvconf" ); err == nil { log.Println( "Link: Detected openresolv" ); return &resolvconfDns{ link: l } }
+			}
+	}
+	return &fileDns{ link: l }
+}
+
+// dnsSet applies the tunnel DNS through the plugged in or the configured DNS manager
+func ( l *Link ) dnsSet( assigned []net.IP ) ( err error ) {
+	servers, err := l.tunnelDns( assigned )
+	if err != nil { log.Println( "Link: [ERR] Tunnel DNS override failed:", err ); return }
+	dns := l.dnsManager
+	if dns == nil { dns = l.newDnsManager() }
+	if l.dnsForwarder != nil && dns.Name() == DnsResolved {																									// systemd-resolved binds its upstream queries to the link, so it can't reach a loopback forwarder through the tunnel link
+		err = errors.New( "the DNS forwarder can't be combined with the " + DnsResolved + " DNS manager" )
+		log.Println( "Link: [ERR] Tunnel DNS override failed:", err ); return
+	}
+	systemServers, forwarder := servers, net.IP( nil )
+	if l.dnsForwarder != nil {																																// Point the system DNS to the local forwarder which forwards to the tunnel DNS servers
+		tunneled := ( func( ip net.IP ) bool )( nil )
+		if l.Config.LeakProtection { tunneled = l.Tunneled }																								// Forward only through the tunnel when leak protection is active
+		if forwarder, err = l.dnsForwarder.Start( servers, tunneled ); err != nil { log.Println( "Link: [ERR] DNS forwarder start failed:", err ); return }
+		systemServers = []net.IP{ forwarder }
+		defer func() { if err != nil { _ = l.dnsForwarder.Stop() } }()
+	}
+	log.Println( "Link: Using", dns.Name(), "DNS manager" )
+	if err = dns.Set( systemServers, l.Config.DnsSearch ); err != nil { return }
+	l.dns = dns
+	l.dnsState = &DnsState{ Manager: l.dns.Name(), Servers: servers, Forwarder: forwarder, Search: l.Config.DnsSearch }
+	return
+}
+
+// dnsRestore removes the tunnel DNS through the DNS manager which applied it
+func ( l *Link ) dnsRestore() ( err error ) {
+	if l.dns == nil { return }
+	err, l.dns = l.dns.Restore(), nil
+	if l.dnsState.Forwarder != nil { if stopErr := l.dnsForwarder.Stop(); err == nil { err = stopErr } }
+	l.dnsState = nil
+	return
+}
+
+// DnsState returns the effective tunnel DNS configuration, nil when the tunnel DNS has not been applied
+func ( l *Link ) DnsState() *DnsState { return l.dnsState }
+
+// tunnelDns picks the configured DNS servers over the server assigned ones. Configured DNS servers must be reachable through the tunnel or a split-tunnel route
+func ( l *Link ) tunnelDns( assigned []net.IP ) ( servers []net.IP, err error ) {
+	if len( l.Config.DnsServers ) == 0 { return assigned, nil }
+	splitTunnel := splitTunnelNetworks( l.Config.SplitTunnel )
+	serverLoop:
+	for _, server := range l.Config.DnsServers {
+		ip := net.ParseIP( server )
+		if ip == nil { err = errors.New( "bad DNS server address " + server ); return }
+		for _, ipNet := range splitTunnel { if ipNet.Contains( ip ) { log.Println( "Link: DNS server", ip, "is reachable through split-tunnel route", ipNet ); servers = append( servers, ip ); continue serverLoop } }
+		if !l.Tunneled( ip ) { err = errors.New( "DNS server " + server + " is not reachable through the tunnel or a split-tunnel route" ); return }
+		servers = append( servers, ip )
+	}
+	log.Println( "Link: Using configured DNS servers", servers, "instead of", assigned )
+	return
+}
+
+// splitTunnelNetworks parses the comma separated split-tunnel CIDR list, unparsable entries are skipped
+func splitTunnelNetworks( splitTunnel string ) ( networks []*net.IPNet ) {
+	for network := range strings.SplitSeq( splitTunnel, "," ) {
+		if _, ipNet, err := net.ParseCIDR( strings.TrimSpace( network ) ); err == nil { networks = append( networks, ipNet ) }
+	}
+	return
+}
+
+// noneDns leaves the system DNS configuration untouched
+type noneDns struct{}
+
+func ( noneDns ) Name() string { return DnsNone }
+func ( noneDns ) Set( addrs []net.IP, search []string ) ( err error ) { log.Println( "Link: [WARN] DNS management disabled, tunnel DNS servers", addrs, "not applied" ); return }
+func ( noneDns ) Restore() ( err error ) { return }
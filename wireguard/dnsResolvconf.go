@@ -0,0 +1,38 @@
+package wireguard
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// resolvconfDns registers the tunnel DNS servers as an interface with resolvconf or openresolv
+type resolvconfDns struct {
+	link		*Link
+	registered	bool
+}
+
+func ( r *resolvconfDns ) Name() string { return DnsResolvconf }
+
+func ( r *resolvconfDns ) Set( addrs []net.IP, search []string ) ( err error ) {
+	content, err := r.link.resolvConfContent( addrs, search, nil )																						// resolvconf merges the directives of other interfaces on its own
+	if err != nil { return }
+	cmd := exec.Command( "resolvconf", "-a", r.link.Config.Name, "-m", "0", "-x" )																			// Metric 0 and exclusive mode, where supported, to take precedence over other interfaces
+	cmd.Stdin = bytes.NewReader( content )
+	if output, err := cmd.CombinedOutput(); err != nil { log.Println( "Link: [ERR] resolvconf registration of", r.link.Config.Name, "failed:", err, strings.TrimSpace( string( output ) ) ); return err }
+	r.registered = true
+	log.Println( "Link: resolvconf DNS for", r.link.Config.Name, "set to", addrs )
+	return
+}
+
+func ( r *resolvconfDns ) Restore() ( err error ) {
+	if !r.registered { return }
+	if output, err := exec.Command( "resolvconf", "-d", r.link.Config.Name, "-f" ).CombinedOutput(); err != nil {
+		log.Println( "Link: [ERR] resolvconf removal of", r.link.Config.Name, "failed:", err, strings.TrimSpace( string( output ) ) ); return err
+	}
+	r.registered = false
+	log.Println( "Link: resolvconf DNS for", r.link.Config.Name, "removed" )
+	return
+}
@@ -0,0 +1,78 @@
+package wireguard
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	resolvedBusName = "org.freedesktop.resolve1"
+	resolvedObjectPath = "/org/freedesktop/resolve1"
+	resolvedManager = "org.freedesktop.resolve1.Manager"
+)
+
+type resolvedAddress struct {																																// D-Bus (iay) structure
+	Family		int32
+	Address		[]byte
+}
+
+type resolvedDomain struct {																																// D-Bus (sb) structure
+	Domain		string
+	RoutingOnly	bool
+}
+
+// resolvedRunning checks if systemd-resolved is present on the system bus
+func resolvedRunning() ( running bool ) {
+	conn, err := dbus.SystemBus()
+	if err != nil { return }
+	_ = conn.BusObject().Call( "org.freedesktop.DBus.NameHasOwner", 0, resolvedBusName ).Store( &running )
+	return
+}
+
+// resolvedDns configures the tunnel DNS servers on the wireguard link through systemd-resolved
+type resolvedDns struct {
+	link		*Link
+	ifIndex		int32
+}
+
+func ( r *resolvedDns ) Name() string { return DnsResolved }
+
+func ( r *resolvedDns ) Set( addrs []net.IP, search []string ) ( err error ) {
+	if r.link.wireguardLink == nil { err = errors.New( "no wireguard interface" ); return }
+	conn, err := dbus.SystemBus()
+	if err != nil { log.Println( "Link: [ERR] System bus connection failed:", err ); return }
+	resolved := conn.Object( resolvedBusName, resolvedObjectPath )
+	r.ifIndex = int32( r.link.wireguardLink.Attrs().Index )
+
+	resolvedAddrs := []resolvedAddress(nil)
+	for _, addr := range addrs {
+		if addr4 := addr.To4(); addr4 != nil { resolvedAddrs = append( resolvedAddrs, resolvedAddress{ Family: unix.AF_INET, Address: addr4 } ); continue }
+		resolvedAddrs = append( resolvedAddrs, resolvedAddress{ Family: unix.AF_INET6, Address: addr.To16() } )
+	}
+	resolvedDomains := []resolvedDomain{ { Domain: ".", RoutingOnly: true } }																				// "~." routes all the queries to this link
+	for _, domain := range search { resolvedDomains = append( resolvedDomains, resolvedDomain{ Domain: domain } ) }
+	defer func() { if err != nil { _ = r.Restore() } }()
+	if err = resolved.Call( resolvedManager + ".SetLinkDNS", 0, r.ifIndex, resolvedAddrs ).Err; err != nil { log.Println( "Link: [ERR] systemd-resolved SetLinkDNS on", r.link.Config.Name, "failed:", err ); return }
+	if err = resolved.Call( resolvedManager + ".SetLinkDomains", 0, r.ifIndex, resolvedDomains ).Err; err != nil {
+		log.Println( "Link: [ERR] systemd-resolved SetLinkDomains on", r.link.Config.Name, "failed:", err ); return
+	}
+	if err = resolved.Call( resolvedManager + ".SetLinkDefaultRoute", 0, r.ifIndex, true ).Err; err != nil { log.Println( "Link: [ERR] systemd-resolved SetLinkDefaultRoute on", r.link.Config.Name, "failed:", err ); return }
+	log.Println( "Link: systemd-resolved DNS for", r.link.Config.Name, "set to", addrs )
+	return
+}
+
+func ( r *resolvedDns ) Restore() ( err error ) {
+	if r.ifIndex == 0 { return }
+	conn, err := dbus.SystemBus()
+	if err != nil { log.Println( "Link: [ERR] System bus connection failed:", err ); return }
+	if err = conn.Object( resolvedBusName, resolvedObjectPath ).Call( resolvedManager + ".RevertLink", 0, r.ifIndex ).Err; err != nil {
+		log.Println( "Link: [ERR] systemd-resolved RevertLink on", r.link.Config.Name, "failed:", err ); return
+	}
+	r.ifIndex = 0
+	log.Println( "Link: systemd-resolved DNS for", r.link.Config.Name, "reverted" )
+	return
+}
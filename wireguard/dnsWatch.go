@@ -0,0 +1,96 @@
+package wireguard
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	resolvConfWatchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM								// Modification, replacement and removal of a directory entry
+	resolvConfSettle = 200 * time.Millisecond																											// Writers often issue several operations, wait for them to finish
+)
+
+// resolvConfWatcher watches /etc/resolv.conf and each element of its symlink chain for modification and replacement
+type resolvConfWatcher struct {
+	sync.Mutex
+	file		*os.File
+	fd			int
+	watches		map[string]int																															// Watched directory to watch descriptor
+	chain		map[string]bool																															// Paths of the symlink chain
+	timer		*time.Timer
+}
+
+// watchResolvConf starts a watcher which calls changed after /etc/resolv.conf or its symlink target gets modified or replaced
+func watchResolvConf( changed func() ) ( w *resolvConfWatcher, err error ) {
+	fd, err := unix.InotifyInit1( unix.IN_NONBLOCK | unix.IN_CLOEXEC )
+	if err != nil { log.Println( "Link: [ERR] inotify init failed:", err ); return }
+	w = &resolvConfWatcher{ file: os.NewFile( uintptr( fd ), "inotify" ), fd: fd, watches: map[string]int{} }									// Non-blocking descriptor gets handled by the runtime poller, so Close interrupts a pending Read
+	w.timer = time.AfterFunc( time.Hour, changed )
+	w.timer.Stop()
+	if err = w.update(); err != nil { _ = w.file.Close(); return nil, err }
+	go w.run()
+	return
+}
+
+// symlinkChain lists /etc/resolv.conf and all the symlinks and the final target it resolves through
+func symlinkChain( path string ) ( chain []string ) {
+	for range 8 {
+		chain = append( chain, path )
+		target, err := os.Readlink( path )
+		if err != nil { return }
+		if !filepath.IsAbs( target ) { target = filepath.Join( filepath.Dir( path ), target ) }
+		path = filepath.Clean( target )
+	}
+	return
+}
+
+// update adds watches for the directories of all the symlink chain elements, a symlink swap changes the chain
+func ( w *resolvConfWatcher ) update() ( err error ) {
+	w.Lock(); defer w.Unlock()
+	w.chain = map[string]bool{}
+	for _, path := range symlinkChain( resolvConfPath ) {
+		w.chain[path] = true
+		dir := filepath.Dir( path )
+		if _, ok := w.watches[dir]; ok { continue }
+		wd, addErr := unix.InotifyAddWatch( w.fd, dir, resolvConfWatchMask )
+		if addErr != nil { log.Println( "Link: [WARN] Watch", dir, "failed:", addErr ); if path == resolvConfPath { err = addErr }; continue }
+		w.watches[dir] = wd
+	}
+	return
+}
+
+func ( w *resolvConfWatcher ) run() {
+	buf := make( []byte, 16 * ( unix.SizeofInotifyEvent + unix.NAME_MAX + 1 ) )
+	for {
+		n, err := w.file.Read( buf )
+		if err != nil { if !errors.Is( err, os.ErrClosed ) { log.Println( "Link: [ERR] resolv.conf watch failed:", err ) }; return }
+		relevant := false
+		for offset := 0; offset + unix.SizeofInotifyEvent <= n; {
+			event := ( *unix.InotifyEvent )( unsafe.Pointer( &buf[offset] ) )
+			nameBytes := buf[offset + unix.SizeofInotifyEvent : offset + unix.SizeofInotifyEvent + int( event.Len )]
+			offset += unix.SizeofInotifyEvent + int( event.Len )
+			w.Lock()
+			for dir, wd := range w.watches {
+				if wd == int( event.Wd ) && w.chain[filepath.Join( dir, string( bytes.TrimRight( nameBytes, "\x00" ) ) )] { relevant = true }
+			}
+			w.Unlock()
+		}
+		if !relevant { continue }
+		_ = w.update()
+		w.timer.Reset( resolvConfSettle )
+	}
+}
+
+// Close stops the watcher
+func ( w *resolvConfWatcher ) Close() {
+	w.timer.Stop()
+	_ = w.file.Close()
+}
@@ -162,4 +162,43 @@ func (l *Link) ThrowRouteDel( logPrefix string, dst *net.IPNet ) ( err error ) {
 	if err = netlink.RouteDel( &route ); err != nil { log.Println( "Link: [ERR]", logPrefix, "throw route", routeString( &route ), "deletion failed:", err ); return }
 	log.Println( "Link:", logPrefix, "throw route", routeString( &route ), "deleted" )
 	return
-}
\ No newline at end of file
+}
+
+// HopRouteAdd adds a route towards dst over the wireguard interface, used to reach the multi-hop exit server through the entry link
+func (l *Link) HopRouteAdd( logPrefix string, dst *net.IPNet ) ( err error ) {
+	route := netlink.Route{
+		LinkIndex:	l.wireguardLink.Attrs().Index,
+		Scope:		unix.RT_SCOPE_LINK,
+		Dst:		dst,
+		Protocol:	unix.RTPROT_BOOT,
+		Table:		l.Config.RoutingTable,
+		Type:		unix.RTN_UNICAST,
+		MTU:		l.mtu,
+	}
+	if err = netlink.RouteAdd( &route ); err != nil { log.Println( "Link: [ERR]", logPrefix, "hop route", routeString( &route ), "addition failed:", err ); return }
+	log.Println( "Link:", logPrefix, "hop route", routeString( &route ), "added" )
+	return
+}
+
+// HopRouteDel removes a route added by HopRouteAdd
+func (l *Link) HopRouteDel( logPrefix string, dst *net.IPNet ) ( err error ) {
+	route := netlink.Route{
+		LinkIndex:	l.wireguardLink.Attrs().Index,
+		Scope:		unix.RT_SCOPE_LINK,
+		Dst:		dst,
+		Protocol:	unix.RTPROT_BOOT,
+		Table:		l.Config.RoutingTable,
+		Type:		unix.RTN_UNICAST,
+	}
+	if err = netlink.RouteDel( &route ); err != nil { log.Println( "Link: [ERR]", logPrefix, "hop route", routeString( &route ), "deletion failed:", err ); return }
+	log.Println( "Link:", logPrefix, "hop route", routeString( &route ), "deleted" )
+	return
+}
+
+// Tunneled checks if traffic towards ip gets routed through the wireguard interface
+func (l *Link) Tunneled( ip net.IP ) bool {
+	if l.wireguardLink == nil { return false }
+	routes, err := netlink.RouteGet( ip )
+	if err != nil || len( routes ) == 0 { return false }
+	return routes[0].LinkIndex == l.wireguardLink.Attrs().Index
+}
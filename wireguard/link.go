@@ -14,6 +14,7 @@ import (
 
 type Config struct {
 	Name					string				`yaml:"name,omitempty"`							// Interface name to use for the created WireGuard interface
+	ExitName				string				`yaml:"exitName,omitempty"`						// Interface name to use for the exit hop WireGuard interface in multi-hop mode
 	ListenPort				int					`yaml:"listenPort,omitempty"`					// Local UDP listen/bind port - 0 for automatic
 	Mark					int					`yaml:"mark,omitempty"`							// Firewall mark for the traffic generated by the wireguard module
 	RPDBPriority			int					`yaml:"rpdbPriority,omitempty"`					// Priority of installed RPDB rules
@@ -21,6 +22,11 @@ type Config struct {
 	RoutingTable			int					`yaml:"routingTable,omitempty"`					// Routing table number to operate on when managing wireguard routes
 	LeakProtection			bool				`yaml:"leakProtection,omitempty"`				// Enable or disable leak protection ( loopback routes )
 	ResolvConfBackupFile	string				`yaml:"resolvConfBackupFile,omitempty"`			// Name of the resolv.conf backup file
+	ResolvConfKeep			[]string			`yaml:"resolvConfKeep,omitempty"`				// Directives ( search, domain ) and options ( edns0, trust-ad, ndots, ... ) kept from the original resolv.conf
+	ResolvConfTemplate		string				`yaml:"resolvConfTemplate,omitempty"`			// text/template for the generated resolv.conf, .Nameservers, .Search, .Domain and .Options are available
+	DnsManager				string				`yaml:"dnsManager,omitempty"`					// DNS backend: auto, resolved, resolvconf, file or none
+	DnsServers				[]string			`yaml:"dnsServers,omitempty"`					// Tunnel DNS server addresses overriding the server assigned ones
+	DnsSearch				[]string			`yaml:"dnsSearch,omitempty"`					// Tunnel DNS search domains
 	DpdTimeout				time.Duration		`yaml:"dpdTimeout,omitempty"`					// DPD timeout
 	SplitTunnel				string				`yaml:"splitTunnel,omitempty"`					// A comma separated list of networks (CIDRs) for which to bypass the wireguard tunnel ( Split-Tunneling )
 	IPv4					bool				`yaml:"IPv4,omitempty"`							// Add routes and rules for IPv4 protocol family
@@ -31,6 +37,7 @@ func ( c *Config ) Check() ( err error ) {
 	if len( c.Name ) == 0 { err = errors.New( "missing wireGuard interface name" ); return }
 	if c.DpdTimeout == 0 { err = errors.New( "dpd timeout not set" ); return }
 	if c.DpdTimeout > time.Minute { err = errors.New( "dpd timeout above 1 minute" ); return }
+	if err = checkDns( c ); err != nil { return }
 	return
 }
 
@@ -45,6 +52,9 @@ type Link struct {
 	
 	peer			wgtypes.PeerConfig
 	
+	transit			bool																																	// Multi-hop entry link, carries just the exit hop traffic
+	underlay		*Link																																	// Multi-hop exit link's entry link
+	
 	ips				[]net.IP
 	routes			[]*netlink.Route																														// Unfortunately, the netlink library can't list routes in the routing tables ...
 	gatewayRoutes	[]*netlink.Route																														// ... other than "main"
@@ -53,18 +63,24 @@ type Link struct {
 	rule			*netlink.Rule																															// Use just one rule when diverting traffic to our routing table
 	rule6			*netlink.Rule
 	
-	resolvConf		[]byte																																	// resolv.conf backup
+	dnsManager		DnsManager																																// Plugged in DNS manager, the configured one gets used when nil
+	dns				DnsManager																																// DNS manager which applied the tunnel DNS
+	dnsState		*DnsState																																// Effective tunnel DNS
+	dnsForwarder	DnsForwarder																															// Local DNS forwarder, none when nil
 	
 	stack			[]func() error
 }
 
 func New( config *Config ) *Link { if config == nil { config = &Config{} }; return &Link{ Config: config } }
 func (l *Link) PublicKey() wgtypes.Key { return l.privateKey.PublicKey() }
+func (l *Link) SetTransit( transit bool ) { l.transit = transit }
+func (l *Link) SetUnderlay( underlay *Link ) { l.underlay = underlay }
 
 // Open the wireguard link, i.e. create or open an existing wireguard interface
 func ( l *Link ) Open() ( err error ) {
 	if err = l.Config.Check(); err != nil { log.Println( "Link: [ERR] Bad WireGuard configuration:", err.Error() ); return }
 	if err = l.handlePrivateKey(); err != nil { return }																									// Check the private key first
+	l.resolvConfRecover()																																	// Undo the DNS changes of a crashed previous run
 	if l.wgClient, err = wgctrl.New(); err != nil { log.Println( "Link: [ERR] Wireguard control client failed:", err ); return }							// Create a wireguard control client
 	if err = l.ipLinkUp(); err != nil { return }																											// Bring the networking interface UP
 	if err = l.wgLinkUp(); err != nil { return }																											// Configure the wireguard private key and listen port
@@ -82,12 +98,17 @@ func ( l *Link ) Up( response *rest.ConnectResponse ) ( err error ) {
 	// On IPv6, we can't go below 1280 as the lowest Internet IPv6 MTU is 1280 bytes
 	// IPv4 header is 20 bytes, IPv6 header is 40 bytes and UDP header is 8 bytes
 	// Wireguard overhead is 32 bytes
-	if response.Endpoint.IP.To4() == nil { l.mtu = 1360 - 80 } else { l.mtu = 1452 - 60 }																	// Calculate MTU according to the carrier connection protocol
+	// A multi-hop exit link gets encapsulated once more by the entry link, so its MTU is derived from the entry link's MTU
+	carrierMtu, overhead := 1452, 60
+	if response.Endpoint.IP.To4() == nil { carrierMtu, overhead = 1360, 80 }
+	if l.underlay != nil { carrierMtu = l.underlay.mtu }
+	l.mtu = carrierMtu - overhead																															// Calculate MTU according to the carrier connection protocol
 	if err = l.ipLinkSetMtu(); err != nil { return }																										// Set the wireguard interface MTU
 	if err = l.wgAddPeer( response.PublicKey, response.PresharedKey, response.Endpoint, response.PersistentKeepaliveInterval ); err != nil { return }		// Add a wireguard peer
 	l.stack = append( l.stack, l.wgRemovePeer )
 	if err = l.ipAddrsAdd( response.AllowedIps ); err != nil { l.Down(); return }																			// Add the IP addresses to the wireguard device
 	l.stack = append( l.stack, l.ipAddrsDel )
+	if l.transit { log.Println( "Link: Up ( multi-hop entry )" ); return }																					// Multi-hop entry link routes just the exit hop, exit link takes care of default routes and DNS
 	if err = l.gatewayRoutesAdd( response ); err != nil { l.Down(); return }																				// Add the default routes over the wireguard interface
 	l.stack = append( l.stack, l.gatewayRoutesRemove )
 	if err = l.dnsSet( response.DNS ); err != nil { l.Down(); return }																						// Set the DNS
@@ -0,0 +1,33 @@
+package wireguard
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+type Telemetry struct {
+	Interface					string			`json:"interface"`								// Interface name
+	MTU							int				`json:"mtu,omitempty"`							// Interface MTU
+	ListenPort					int				`json:"listenPort,omitempty"`					// Local UDP listen port
+	FirewallMark				int				`json:"firewallMark,omitempty"`					// Firewall mark of the encrypted traffic
+	Endpoint					*net.UDPAddr	`json:"endpoint,omitempty"`						// Peer's endpoint as currently seen by the kernel ( changes on roaming )
+	LastHandshake				*time.Time		`json:"lastHandshake,omitempty"`				// Time of the last successful handshake, nil when no handshake took place yet
+	PersistentKeepaliveInterval	time.Duration	`json:"persistentKeepalive,omitempty"`			// Keepalive interval configured on the peer
+}
+
+// Telemetry fetches the interface and peer properties from the kernel
+func ( l *Link ) Telemetry() ( telemetry *Telemetry, err error ) {
+	device, err := l.wgClient.Device( l.Config.Name )
+	if err != nil { return }
+	telemetry = &Telemetry{ Interface: device.Name, ListenPort: device.ListenPort, FirewallMark: device.FirewallMark }
+	if link, linkErr := netlink.LinkByName( l.Config.Name ); linkErr == nil { telemetry.MTU = link.Attrs().MTU } else { telemetry.MTU = l.mtu }		// Fall back to the configured MTU when the interface can't be looked up
+	if len( device.Peers ) == 0 { err = errors.New( "no peer on a wireguard device" ); return }
+	peer := device.Peers[0]
+	telemetry.Endpoint = peer.Endpoint
+	telemetry.PersistentKeepaliveInterval = peer.PersistentKeepaliveInterval
+	if !peer.LastHandshakeTime.IsZero() { telemetry.LastHandshake = &peer.LastHandshakeTime }
+	return
+}